@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"errors"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Token is an OAuth 2.0 access token.
+type Token struct {
+	// AccessToken is the token sent to the SMTP server.
+	AccessToken string
+	// Expiry is the expiration time of the token. A zero Expiry means the
+	// token never expires.
+	Expiry time.Time
+}
+
+// A TokenSource returns OAuth 2.0 access tokens.
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+// A TokenSourceFunc is an adapter to allow the use of ordinary functions as
+// token sources.
+type TokenSourceFunc func() (*Token, error)
+
+// Token calls f().
+func (f TokenSourceFunc) Token() (*Token, error) {
+	return f()
+}
+
+// StaticTokenSource returns a TokenSource that always returns the given access
+// token.
+func StaticTokenSource(accessToken string) TokenSource {
+	return TokenSourceFunc(func() (*Token, error) {
+		return &Token{AccessToken: accessToken}, nil
+	})
+}
+
+// expiryDelta is how long before its expiration a token is refreshed, so that
+// it does not expire during the SMTP session.
+const expiryDelta = time.Minute
+
+// ReuseTokenSource returns a TokenSource that caches the token returned by src
+// and asks src for a new one shortly before it expires. It is safe for
+// concurrent use.
+//
+// The XOAUTH2 and OAUTHBEARER mechanisms also ask for a new token when the
+// SMTP server rejects the cached one.
+func ReuseTokenSource(src TokenSource) TokenSource {
+	return &reuseTokenSource{src: src}
+}
+
+type reuseTokenSource struct {
+	src TokenSource
+
+	mu  sync.Mutex
+	tok *Token
+}
+
+func (s *reuseTokenSource) Token() (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok != nil && (s.tok.Expiry.IsZero() || time.Now().Add(expiryDelta).Before(s.tok.Expiry)) {
+		return s.tok, nil
+	}
+
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+func (s *reuseTokenSource) invalidate() {
+	s.mu.Lock()
+	s.tok = nil
+	s.mu.Unlock()
+}
+
+// oauthAuth contains what is common to the XOAUTH2 and OAUTHBEARER
+// mechanisms.
+type oauthAuth struct {
+	mu       sync.Mutex
+	rejected bool
+}
+
+func (a *oauthAuth) start(server *smtp.ServerInfo, host string, ts TokenSource) (*Token, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return nil, errors.New("gomail: unencrypted connection")
+	}
+	if server.Name != host {
+		return nil, errors.New("gomail: wrong host name")
+	}
+	if ts == nil {
+		return nil, errors.New("gomail: no token source")
+	}
+
+	a.mu.Lock()
+	a.rejected = false
+	a.mu.Unlock()
+
+	return ts.Token()
+}
+
+// challenged handles the error challenge sent by the server when it rejects
+// the token.
+func (a *oauthAuth) challenged(more bool) bool {
+	if !more {
+		return false
+	}
+	a.mu.Lock()
+	a.rejected = true
+	a.mu.Unlock()
+	return true
+}
+
+func (a *oauthAuth) retry(ts TokenSource) bool {
+	a.mu.Lock()
+	rejected := a.rejected
+	a.rejected = false
+	a.mu.Unlock()
+
+	if !rejected {
+		return false
+	}
+	if s, ok := ts.(interface{ invalidate() }); ok {
+		s.invalidate()
+		return true
+	}
+	return false
+}
+
+// XOAuth2Auth is a smtp.Auth that implements the XOAUTH2 authentication
+// mechanism used by Gmail and Office 365.
+type XOAuth2Auth struct {
+	Username    string
+	TokenSource TokenSource
+	Host        string
+
+	oauthAuth
+}
+
+// Start implements smtp.Auth.
+func (a *XOAuth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	tok, err := a.start(server, a.Host, a.TokenSource)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp := "user=" + a.Username + "\x01auth=Bearer " + tok.AccessToken + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+// Next implements smtp.Auth.
+func (a *XOAuth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if a.challenged(more) {
+		// The server sent an error as a challenge. An empty response must be
+		// sent to get the final error reply.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// Retry reports whether the authentication failed because the token was
+// rejected, in which case a new token is fetched and the authentication should
+// be tried again. It only returns true if TokenSource was created with
+// ReuseTokenSource.
+func (a *XOAuth2Auth) Retry() bool {
+	return a.retry(a.TokenSource)
+}
+
+// OAuthBearerAuth is a smtp.Auth that implements the OAUTHBEARER
+// authentication mechanism defined in RFC 7628.
+type OAuthBearerAuth struct {
+	Username    string
+	TokenSource TokenSource
+	Host        string
+	// Port is the port of the SMTP server sent to the server. It is not sent
+	// if zero.
+	Port int
+
+	oauthAuth
+}
+
+// Start implements smtp.Auth.
+func (a *OAuthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	tok, err := a.start(server, a.Host, a.TokenSource)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp := "n,a=" + saslName(a.Username) + ",\x01host=" + a.Host + "\x01"
+	if a.Port != 0 {
+		resp += "port=" + strconv.Itoa(a.Port) + "\x01"
+	}
+	resp += "auth=Bearer " + tok.AccessToken + "\x01\x01"
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+// Next implements smtp.Auth.
+func (a *OAuthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if a.challenged(more) {
+		// The server sent an error as a challenge. RFC 7628 requires a dummy
+		// response to get the final error reply.
+		return []byte{0x01}, nil
+	}
+	return nil, nil
+}
+
+// Retry reports whether the authentication failed because the token was
+// rejected, in which case a new token is fetched and the authentication should
+// be tried again. It only returns true if TokenSource was created with
+// ReuseTokenSource.
+func (a *OAuthBearerAuth) Retry() bool {
+	return a.retry(a.TokenSource)
+}
+
+// saslName escapes the "," and "=" characters as required in the GS2 header.
+func saslName(name string) string {
+	var buf []byte
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case ',':
+			buf = append(buf, "=2C"...)
+		case '=':
+			buf = append(buf, "=3D"...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+const testToken = "token"
+
+func TestXOAuth2(t *testing.T) {
+	a := &XOAuth2Auth{
+		Username:    TestUser,
+		TokenSource: StaticTokenSource(testToken),
+		Host:        TestHost,
+	}
+	proto, toServer, err := a.Start(&smtp.ServerInfo{Name: TestHost, TLS: true})
+	if err != nil {
+		t.Fatalf("XOAuth2Auth.Start(): %v", err)
+	}
+	if proto != "XOAUTH2" {
+		t.Errorf("Invalid protocol, got %q, want XOAUTH2", proto)
+	}
+	want := "user=" + TestUser + "\x01auth=Bearer " + testToken + "\x01\x01"
+	if got := string(toServer); got != want {
+		t.Errorf("Invalid response, got %q, want %q", got, want)
+	}
+
+	toServer, err = a.Next([]byte(`{"status":"400"}`), true)
+	if err != nil {
+		t.Fatalf("XOAuth2Auth.Next(): %v", err)
+	}
+	if toServer == nil || len(toServer) != 0 {
+		t.Errorf("Invalid response to an error challenge, got %q, want an empty response", toServer)
+	}
+	if a.Retry() {
+		t.Error("Retry() should be false with a static token source")
+	}
+}
+
+func TestOAuthBearer(t *testing.T) {
+	a := &OAuthBearerAuth{
+		Username:    "user,name=",
+		TokenSource: StaticTokenSource(testToken),
+		Host:        TestHost,
+		Port:        587,
+	}
+	proto, toServer, err := a.Start(&smtp.ServerInfo{Name: TestHost, TLS: true})
+	if err != nil {
+		t.Fatalf("OAuthBearerAuth.Start(): %v", err)
+	}
+	if proto != "OAUTHBEARER" {
+		t.Errorf("Invalid protocol, got %q, want OAUTHBEARER", proto)
+	}
+	want := "n,a=user=2Cname=3D,\x01host=" + TestHost + "\x01port=587\x01auth=Bearer " + testToken + "\x01\x01"
+	if got := string(toServer); got != want {
+		t.Errorf("Invalid response, got %q, want %q", got, want)
+	}
+
+	toServer, err = a.Next([]byte(`{"status":"invalid_token"}`), true)
+	if err != nil {
+		t.Fatalf("OAuthBearerAuth.Next(): %v", err)
+	}
+	if got := string(toServer); got != "\x01" {
+		t.Errorf("Invalid response to an error challenge, got %q, want %q", got, "\x01")
+	}
+}
+
+func TestOAuthNoTLS(t *testing.T) {
+	a := &XOAuth2Auth{Username: TestUser, TokenSource: StaticTokenSource(testToken), Host: TestHost}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: TestHost}); err == nil {
+		t.Error("Start() should fail on an unencrypted connection")
+	}
+
+	a.Host = "localhost"
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "localhost"}); err != nil {
+		t.Errorf("Start() should succeed on localhost, got %v", err)
+	}
+}
+
+func TestOAuthWrongHost(t *testing.T) {
+	a := &OAuthBearerAuth{Username: TestUser, TokenSource: StaticTokenSource(testToken), Host: TestHost}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "evil.example.com", TLS: true}); err == nil {
+		t.Error("Start() should fail with a wrong host name")
+	}
+}
+
+func TestReuseTokenSource(t *testing.T) {
+	n := 0
+	expiry := time.Now().Add(time.Hour)
+	ts := ReuseTokenSource(TokenSourceFunc(func() (*Token, error) {
+		n++
+		return &Token{AccessToken: testToken, Expiry: expiry}, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("The token should be reused, got %d calls", n)
+	}
+
+	expiry = time.Now().Add(30 * time.Second)
+	ts.(*reuseTokenSource).invalidate()
+	ts.Token()
+	ts.Token()
+	if n != 3 {
+		t.Errorf("A token about to expire should be refreshed, got %d calls, want 3", n)
+	}
+}
+
+func TestOAuthRetry(t *testing.T) {
+	n := 0
+	a := &XOAuth2Auth{
+		Username: TestUser,
+		TokenSource: ReuseTokenSource(TokenSourceFunc(func() (*Token, error) {
+			n++
+			return &Token{AccessToken: testToken}, nil
+		})),
+		Host: TestHost,
+	}
+	server := &smtp.ServerInfo{Name: TestHost, TLS: true}
+
+	a.Start(server)
+	if a.Retry() {
+		t.Error("Retry() should be false if the token was not rejected")
+	}
+
+	a.Start(server)
+	a.Next([]byte(`{"status":"401"}`), true)
+	if !a.Retry() {
+		t.Error("Retry() should be true if the token was rejected")
+	}
+	a.Start(server)
+	if n != 2 {
+		t.Errorf("A rejected token should be refreshed, got %d calls, want 2", n)
+	}
+}
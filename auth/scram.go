@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ScramAuth is a smtp.Auth that implements the SCRAM-SHA-1 and SCRAM-SHA-256
+// authentication mechanisms defined in RFC 5802 and RFC 7677, and their -PLUS
+// variants using channel binding. The password is never sent to the server and
+// the server is authenticated by verifying its signature.
+//
+// The username and the password are not prepared with SASLprep so they should
+// only contain ASCII characters.
+//
+// The state of the exchange is reset by Start, so a ScramAuth can be reused
+// but it cannot run several exchanges at once. smtp.Dialer uses a copy of it
+// for each connection, with the TLSConnectionState of the connection.
+type ScramAuth struct {
+	Username string
+	Password string
+	Host     string
+	// Mechanism is the name of the mechanism: SCRAM-SHA-1, SCRAM-SHA-1-PLUS,
+	// SCRAM-SHA-256 or SCRAM-SHA-256-PLUS. By default, SCRAM-SHA-256 is used.
+	Mechanism string
+	// TLSConnectionState is the state of the TLS connection to the server. It
+	// is required by the -PLUS mechanisms to bind the authentication to the
+	// TLS connection. With the other mechanisms, it tells the server that
+	// channel binding is supported by the client, unless the server
+	// advertises the -PLUS variant of the mechanism.
+	TLSConnectionState *tls.ConnectionState
+
+	mu sync.Mutex
+	ex *scramExchange
+}
+
+// scramExchange is the state of an exchange started by ScramAuth.Start.
+type scramExchange struct {
+	password        string
+	cs              *tls.ConnectionState
+	hash            func() hash.Hash
+	gs2Header       string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+// randomNonce returns the client nonce. It is a variable so that it can be
+// replaced in tests.
+var randomNonce = func() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// Start implements smtp.Auth.
+func (a *ScramAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if server.Name != a.Host {
+		return "", nil, errors.New("gomail: wrong host name")
+	}
+
+	ex := &scramExchange{password: a.Password, cs: a.TLSConnectionState}
+	mechanism := a.Mechanism
+	if mechanism == "" {
+		mechanism = "SCRAM-SHA-256"
+	}
+	plus := strings.HasSuffix(mechanism, "-PLUS")
+	switch strings.TrimSuffix(mechanism, "-PLUS") {
+	case "SCRAM-SHA-1":
+		ex.hash = sha1.New
+	case "SCRAM-SHA-256":
+		ex.hash = sha256.New
+	default:
+		return "", nil, fmt.Errorf("gomail: unsupported SCRAM mechanism %q", mechanism)
+	}
+
+	switch {
+	case plus && ex.cs == nil:
+		return "", nil, fmt.Errorf("gomail: %s requires a TLS connection", mechanism)
+	case plus:
+		ex.gs2Header = "p=" + channelBindingType(ex.cs) + ",,"
+	case ex.cs != nil && !hasMechanism(server.Auth, mechanism+"-PLUS"):
+		// The client supports channel binding but the server does not. If
+		// the server supports it, RFC 5802 requires it to reject the "y"
+		// flag since the -PLUS mechanism should have been used.
+		ex.gs2Header = "y,,"
+	default:
+		ex.gs2Header = "n,,"
+	}
+
+	nonce, err := randomNonce()
+	if err != nil {
+		return "", nil, err
+	}
+	ex.clientNonce = nonce
+	ex.clientFirstBare = "n=" + saslName(a.Username) + ",r=" + nonce
+
+	a.mu.Lock()
+	a.ex = ex
+	a.mu.Unlock()
+	return mechanism, []byte(ex.gs2Header + ex.clientFirstBare), nil
+}
+
+// Next implements smtp.Auth.
+func (a *ScramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	a.mu.Lock()
+	ex := a.ex
+	a.mu.Unlock()
+	if ex == nil {
+		return nil, errors.New("gomail: unexpected SCRAM server message")
+	}
+	return ex.next(fromServer, more)
+}
+
+func (ex *scramExchange) next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		if ex.verified {
+			return nil, nil
+		}
+		// The server may send its final message with the success reply.
+		if b, err := base64.StdEncoding.DecodeString(string(fromServer)); err == nil {
+			fromServer = b
+		}
+		if err := ex.verify(fromServer); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if ex.serverSignature == nil {
+		return ex.clientFinal(fromServer)
+	}
+	if err := ex.verify(fromServer); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+func (ex *scramExchange) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs, err := scramAttributes(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, ex.clientNonce) || len(nonce) == len(ex.clientNonce) {
+		return nil, errors.New("gomail: invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("gomail: invalid SCRAM salt")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 {
+		return nil, errors.New("gomail: invalid SCRAM iteration count")
+	}
+
+	cbData := []byte(ex.gs2Header)
+	if strings.HasPrefix(ex.gs2Header, "p=") {
+		cb, err := channelBinding(ex.cs)
+		if err != nil {
+			return nil, err
+		}
+		cbData = append(cbData, cb...)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbData) + ",r=" + nonce
+	authMessage := []byte(ex.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+
+	saltedPassword := pbkdf2(ex.hash, []byte(ex.password), salt, iter)
+	clientKey := ex.hmac(saltedPassword, []byte("Client Key"))
+	h := ex.hash()
+	h.Write(clientKey)
+	clientSignature := ex.hmac(h.Sum(nil), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := ex.hmac(saltedPassword, []byte("Server Key"))
+	ex.serverSignature = ex.hmac(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (ex *scramExchange) verify(serverFinal []byte) error {
+	if ex.serverSignature == nil {
+		return errors.New("gomail: unexpected SCRAM server message")
+	}
+	attrs, err := scramAttributes(serverFinal)
+	if err != nil {
+		return err
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(v, ex.serverSignature) {
+		return errors.New("gomail: invalid SCRAM server signature")
+	}
+	ex.verified = true
+	return nil
+}
+
+func (ex *scramExchange) hmac(key, data []byte) []byte {
+	mac := hmac.New(ex.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func hasMechanism(auths []string, mechanism string) bool {
+	for _, m := range auths {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// scramAttributes parses a message sent by the server.
+func scramAttributes(b []byte) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(string(b), ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, fmt.Errorf("gomail: invalid SCRAM server message: %q", b)
+		}
+		attrs[field[:1]] = field[2:]
+	}
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("gomail: SCRAM authentication failed: %s", e)
+	}
+	return attrs, nil
+}
+
+// pbkdf2 implements the Hi function of RFC 5802, which is PBKDF2 with HMAC
+// and an output length equal to the size of the hash.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// channelBindingType returns the channel binding type used with the given
+// connection: tls-exporter (RFC 9266) with TLS 1.3 and tls-unique before.
+func channelBindingType(cs *tls.ConnectionState) string {
+	if cs.Version >= tls.VersionTLS13 {
+		return "tls-exporter"
+	}
+	return "tls-unique"
+}
+
+func channelBinding(cs *tls.ConnectionState) ([]byte, error) {
+	if cs.Version >= tls.VersionTLS13 {
+		return cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	}
+	if len(cs.TLSUnique) == 0 {
+		return nil, errors.New("gomail: channel binding is not available")
+	}
+	return cs.TLSUnique, nil
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+type scramTest struct {
+	mechanism   string
+	username    string
+	password    string
+	nonce       string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}
+
+// The test vectors come from RFC 5802 and RFC 7677.
+var scramTests = []scramTest{
+	{
+		mechanism:   "SCRAM-SHA-1",
+		username:    "user",
+		password:    "pencil",
+		nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mechanism:   "SCRAM-SHA-256",
+		username:    "user",
+		password:    "pencil",
+		nonce:       "rOprNGfwEbeRWgbNEkqO",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func stubNonce(t *testing.T, nonce string) {
+	old := randomNonce
+	randomNonce = func() (string, error) {
+		return nonce, nil
+	}
+	t.Cleanup(func() {
+		randomNonce = old
+	})
+}
+
+func TestScram(t *testing.T) {
+	for _, test := range scramTests {
+		stubNonce(t, test.nonce)
+		a := &ScramAuth{
+			Username:  test.username,
+			Password:  test.password,
+			Host:      TestHost,
+			Mechanism: test.mechanism,
+		}
+
+		proto, toServer, err := a.Start(&smtp.ServerInfo{Name: TestHost})
+		if err != nil {
+			t.Fatalf("ScramAuth.Start(): %v", err)
+		}
+		if proto != test.mechanism {
+			t.Errorf("Invalid protocol, got %q, want %q", proto, test.mechanism)
+		}
+		if got := string(toServer); got != test.clientFirst {
+			t.Errorf("Invalid client-first message, got %q, want %q", got, test.clientFirst)
+		}
+
+		toServer, err = a.Next([]byte(test.serverFirst), true)
+		if err != nil {
+			t.Fatalf("ScramAuth.Next(): %v", err)
+		}
+		if got := string(toServer); got != test.clientFinal {
+			t.Errorf("Invalid client-final message, got %q, want %q", got, test.clientFinal)
+		}
+
+		toServer, err = a.Next([]byte(test.serverFinal), true)
+		if err != nil {
+			t.Fatalf("ScramAuth.Next(): %v", err)
+		}
+		if toServer == nil || len(toServer) != 0 {
+			t.Errorf("Invalid response, got %q, want an empty response", toServer)
+		}
+		if _, err := a.Next([]byte("2.7.0 Authentication successful"), false); err != nil {
+			t.Errorf("ScramAuth.Next(): %v", err)
+		}
+	}
+}
+
+func TestScramServerFinalWithSuccess(t *testing.T) {
+	test := scramTests[1]
+	stubNonce(t, test.nonce)
+	a := &ScramAuth{Username: test.username, Password: test.password, Host: TestHost}
+
+	a.Start(&smtp.ServerInfo{Name: TestHost})
+	if _, err := a.Next([]byte(test.serverFirst), true); err != nil {
+		t.Fatal(err)
+	}
+	final := base64.StdEncoding.EncodeToString([]byte(test.serverFinal))
+	if _, err := a.Next([]byte(final), false); err != nil {
+		t.Errorf("The server signature sent with the success reply should be accepted, got %v", err)
+	}
+}
+
+func TestScramInvalidServerSignature(t *testing.T) {
+	test := scramTests[1]
+	stubNonce(t, test.nonce)
+	a := &ScramAuth{Username: test.username, Password: test.password, Host: TestHost}
+
+	a.Start(&smtp.ServerInfo{Name: TestHost})
+	if _, err := a.Next([]byte(test.serverFirst), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Next([]byte("v=AAAA"), true); err == nil {
+		t.Error("An invalid server signature should be rejected")
+	}
+}
+
+func TestScramMissingServerSignature(t *testing.T) {
+	test := scramTests[1]
+	stubNonce(t, test.nonce)
+	a := &ScramAuth{Username: test.username, Password: test.password, Host: TestHost}
+
+	a.Start(&smtp.ServerInfo{Name: TestHost})
+	if _, err := a.Next([]byte("2.7.0 Authentication successful"), false); err == nil {
+		t.Error("A success without the server signature should be rejected")
+	}
+}
+
+func TestScramServerErrors(t *testing.T) {
+	test := scramTests[1]
+	stubNonce(t, test.nonce)
+
+	for _, serverFirst := range []string{
+		"e=unknown-user",
+		"r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=" + test.nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=" + test.nonce + "x,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"r=" + test.nonce + "x,s=,i=4096",
+		"garbage",
+	} {
+		a := &ScramAuth{Username: test.username, Password: test.password, Host: TestHost}
+		a.Start(&smtp.ServerInfo{Name: TestHost})
+		if _, err := a.Next([]byte(serverFirst), true); err == nil {
+			t.Errorf("Next(%q) should fail", serverFirst)
+		}
+	}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	test := scramTests[1]
+	stubNonce(t, test.nonce)
+
+	unique := []byte("0123456789ab")
+	a := &ScramAuth{
+		Username:  test.username,
+		Password:  test.password,
+		Host:      TestHost,
+		Mechanism: "SCRAM-SHA-256-PLUS",
+		TLSConnectionState: &tls.ConnectionState{
+			Version:   tls.VersionTLS12,
+			TLSUnique: unique,
+		},
+	}
+
+	proto, toServer, err := a.Start(&smtp.ServerInfo{Name: TestHost, TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "SCRAM-SHA-256-PLUS" {
+		t.Errorf("Invalid protocol, got %q, want SCRAM-SHA-256-PLUS", proto)
+	}
+	if want := "p=tls-unique,,n=user,r=" + test.nonce; string(toServer) != want {
+		t.Errorf("Invalid client-first message, got %q, want %q", toServer, want)
+	}
+
+	toServer, err = a.Next([]byte(test.serverFirst), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=" + base64.StdEncoding.EncodeToString(append([]byte("p=tls-unique,,"), unique...)) + ","
+	if !strings.HasPrefix(string(toServer), want) {
+		t.Errorf("Invalid client-final message, got %q, want prefix %q", toServer, want)
+	}
+}
+
+func TestScramChannelBindingFlag(t *testing.T) {
+	tests := []struct {
+		auths []string
+		want  string
+	}{
+		{[]string{"SCRAM-SHA-256"}, "y,,"},
+		{[]string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}, "n,,"},
+		{[]string{"SCRAM-SHA-256", "scram-sha-256-plus"}, "n,,"},
+		{[]string{"SCRAM-SHA-256", "SCRAM-SHA-1-PLUS"}, "y,,"},
+	}
+
+	for _, test := range tests {
+		a := &ScramAuth{
+			Username:           TestUser,
+			Password:           TestPwd,
+			Host:               TestHost,
+			TLSConnectionState: &tls.ConnectionState{Version: tls.VersionTLS13},
+		}
+		_, toServer, err := a.Start(&smtp.ServerInfo{Name: TestHost, TLS: true, Auth: test.auths})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(toServer), test.want) {
+			t.Errorf("Invalid GS2 header with %q, got %q, want prefix %q", test.auths, toServer, test.want)
+		}
+	}
+}
+
+func TestScramPlusWithoutTLS(t *testing.T) {
+	a := &ScramAuth{Username: TestUser, Password: TestPwd, Host: TestHost, Mechanism: "SCRAM-SHA-256-PLUS"}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: TestHost}); err == nil {
+		t.Error("Start() should fail without a TLS connection")
+	}
+}
+
+func TestScramWrongHost(t *testing.T) {
+	a := &ScramAuth{Username: TestUser, Password: TestPwd, Host: TestHost}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "evil.example.com"}); err == nil {
+		t.Error("Start() should fail with a wrong host name")
+	}
+}
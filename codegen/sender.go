@@ -9,10 +9,11 @@ import (
 	"errors"
 	"fmt"
 	l4g "github.com/alecthomas/log4go"
+	"github.com/hacku7/gomail/msg"
+	"github.com/hacku7/gomail/smtp"
 	"github.com/hacku7/gomail/utils"
 	"github.com/nicksnyder/go-i18n/i18n"
 	"github.com/spf13/viper"
-	"gopkg.in/gomail.v2"
 	"html/template"
 	"math/rand"
 	"os"
@@ -115,14 +116,23 @@ func initVerifyCode(userEmail, subject, locale string, cfg *utils.Config) (strin
 
 // sendVerifyCode 邮件发送
 func sendVerifyCode(userEmail, subject, body string, cfg *utils.Config) (err error) {
-	m := gomail.NewMessage()
+	m := msg.NewMessage()
 	m.SetHeader("From", cfg.FeedbackEmail)
 	m.SetHeader("To", userEmail)
 	m.SetHeader("Subject", subject)
 	m.SetBody("text/html", body)
 
 	port, err := strconv.Atoi(cfg.SMTPPort)
-	mailer := gomail.NewDialer(cfg.SMTPServer, port, cfg.SMTPUsername, cfg.SMTPPassword)
+	mailer := smtp.NewDialer(cfg.SMTPServer, port, cfg.SMTPUsername, cfg.SMTPPassword)
+	if cfg.ConnectionSecurity != "" {
+		policy, err := smtp.ParseTLSPolicy(cfg.ConnectionSecurity)
+		if err != nil {
+			l4g.Error(err)
+			return err
+		}
+		mailer.SSL = false
+		mailer.TLSPolicy = policy
+	}
 
 	if err = mailer.DialAndSend(m); err != nil {
 		l4g.Error(err)
@@ -0,0 +1,208 @@
+// Package merge sends personalized copies of a msg to a list of recipients.
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hacku7/gomail/msg"
+	"github.com/hacku7/gomail/send"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"strings"
+	"text/template"
+)
+
+// A Recipient is a recipient of a mail merge. It is the data used to execute
+// the templates of the msg, for example {{.Name}} or {{.Data.Code}}.
+type Recipient struct {
+	Address string
+	Name    string
+	Data    map[string]interface{}
+}
+
+// A Source yields the recipients of a mail merge. Next returns io.EOF when
+// there are no more recipients.
+type Source interface {
+	Next() (*Recipient, error)
+}
+
+// Recipients returns a Source yielding the given recipients.
+func Recipients(list ...Recipient) Source {
+	return &sliceSource{list: list}
+}
+
+type sliceSource struct {
+	list []Recipient
+}
+
+func (s *sliceSource) Next() (*Recipient, error) {
+	if len(s.list) == 0 {
+		return nil, io.EOF
+	}
+	r := &s.list[0]
+	s.list = s.list[1:]
+	return r, nil
+}
+
+// A SourceFunc is an adapter to allow the use of ordinary functions as
+// recipient sources.
+type SourceFunc func() (*Recipient, error)
+
+// Next calls f().
+func (f SourceFunc) Next() (*Recipient, error) {
+	return f()
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// A Merger personalizes a base msg for each recipient.
+//
+// The header values and the body parts of the base msg are parsed as
+// text/template templates, except the text/html parts which are parsed as
+// html/template templates. For each recipient, the To header field is set to
+// the recipient address, and the Cc and Bcc header fields are removed.
+type Merger struct {
+	base    *msg.Message
+	headers map[string][]*template.Template
+	parts   []executor
+}
+
+// New creates a Merger from the base msg. The base msg must not be modified
+// afterwards. The body parts are rendered once to parse them.
+func New(base *msg.Message) (*Merger, error) {
+	mg := &Merger{
+		base:    base.Clone(),
+		headers: make(map[string][]*template.Template),
+	}
+	mg.base.DelHeader("To")
+	mg.base.DelHeader("Cc")
+	mg.base.DelHeader("Bcc")
+
+	dec := new(mime.WordDecoder)
+	for _, k := range mg.base.Header.Keys() {
+		values := mg.base.Header.Values(k)
+		tmpls := make([]*template.Template, len(values))
+		for i, v := range values {
+			if s, err := dec.DecodeHeader(v); err == nil {
+				v = s
+			}
+			if !strings.Contains(v, "{{") {
+				continue
+			}
+
+			t, err := template.New(k).Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf("gomail: invalid template in header %q: %v", k, err)
+			}
+			tmpls[i] = t
+		}
+		mg.headers[k] = tmpls
+	}
+
+	for i, p := range mg.base.Parts {
+		var buf bytes.Buffer
+		if err := p.Copier(&buf); err != nil {
+			return nil, err
+		}
+
+		var t executor
+		var err error
+		if mediaType(p.ContentType) == "text/html" {
+			t, err = htmltemplate.New("part").Parse(buf.String())
+		} else {
+			t, err = template.New("part").Parse(buf.String())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gomail: invalid template in part %d: %v", i+1, err)
+		}
+		mg.parts = append(mg.parts, t)
+	}
+
+	return mg, nil
+}
+
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Message returns the msg personalized for the given recipient.
+func (mg *Merger) Message(r *Recipient) (*msg.Message, error) {
+	if r.Address == "" {
+		return nil, errors.New("gomail: recipient address is empty")
+	}
+
+	m := mg.base.Clone()
+	var buf bytes.Buffer
+	for k, tmpls := range mg.headers {
+		values := m.Header.Values(k)
+		changed := false
+		for i, t := range tmpls {
+			if t == nil {
+				continue
+			}
+			buf.Reset()
+			if err := t.Execute(&buf, r); err != nil {
+				return nil, err
+			}
+			values[i] = buf.String()
+			changed = true
+		}
+		if changed {
+			m.SetHeader(k, values...)
+		}
+	}
+	m.SetAddressHeader("To", r.Address, r.Name)
+
+	for i, t := range mg.parts {
+		t := t
+		m.Parts[i].Copier = func(w io.Writer) error {
+			return t.Execute(w, r)
+		}
+	}
+
+	return m, nil
+}
+
+// Send sends a personalized msg to each recipient yielded by src, one at a
+// time. It stops at the first error.
+func (mg *Merger) Send(s send.Sender, src Source) error {
+	for {
+		r, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := mg.send(s, r); err != nil {
+			return fmt.Errorf("gomail: could not send email to %q: %w", r.Address, err)
+		}
+	}
+}
+
+func (mg *Merger) send(s send.Sender, r *Recipient) error {
+	m, err := mg.Message(r)
+	if err != nil {
+		return err
+	}
+
+	from, err := m.GetFrom()
+	if err != nil {
+		return err
+	}
+
+	to, err := m.GetRecipients()
+	if err != nil {
+		return err
+	}
+
+	return s.Send(from, to, m)
+}
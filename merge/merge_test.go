@@ -0,0 +1,123 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hacku7/gomail/msg"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getTestMessage() *msg.Message {
+	m := msg.NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "ignored@example.com")
+	m.SetHeader("Cc", "cc@example.com")
+	m.SetHeader("Subject", "¡Hola {{.Name}}!")
+	m.SetHeader("X-Code", "{{.Data.Code}}")
+	m.SetBody("text/plain", "Hello {{.Name}}, your code is {{.Data.Code}}.")
+	m.AddAlternative("text/html", "<p>Hello {{.Name}}, your code is <b>{{.Data.Code}}</b>.</p>")
+	return m
+}
+
+func TestSend(t *testing.T) {
+	mg, err := New(getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var to [][]string
+	s := send.SendFunc(func(from string, rcpt []string, m io.WriterTo) error {
+		if from != "from@example.com" {
+			t.Errorf("Invalid from, got %q, want %q", from, "from@example.com")
+		}
+		to = append(to, rcpt)
+
+		buf := new(bytes.Buffer)
+		if _, err := m.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf.String())
+		return nil
+	})
+
+	err = mg.Send(s, Recipients(
+		Recipient{Address: "bob@example.com", Name: "Bob", Data: map[string]interface{}{"Code": "123"}},
+		Recipient{Address: "cora@example.com", Name: "Cora <&>", Data: map[string]interface{}{"Code": "456"}},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTo := [][]string{{"bob@example.com"}, {"cora@example.com"}}
+	if !reflect.DeepEqual(to, wantTo) {
+		t.Errorf("Invalid recipients, got %q, want %q", to, wantTo)
+	}
+
+	for _, want := range []string{
+		"To: \"Bob\" <bob@example.com>\r\n",
+		"Subject: =?UTF-8?q?=C2=A1Hola_Bob!?=\r\n",
+		"X-Code: 123\r\n",
+		"Hello Bob, your code is 123.",
+		"<p>Hello Bob, your code is <b>123</b>.</p>",
+	} {
+		if !strings.Contains(got[0], want) {
+			t.Errorf("Missing %q in msg:\n%s", want, got[0])
+		}
+	}
+	for _, want := range []string{
+		"Subject: =?UTF-8?q?=C2=A1Hola_Cora_<&>!?=\r\n",
+		"X-Code: 456\r\n",
+		"Hello Cora <&>, your code is 456.",
+		"<p>Hello Cora &lt;&amp;&gt;, your code is <b>456</b>.</p>",
+	} {
+		if !strings.Contains(got[1], want) {
+			t.Errorf("Missing %q in msg:\n%s", want, got[1])
+		}
+	}
+	if strings.Contains(got[0], "Cc:") || strings.Contains(got[0], "ignored@example.com") {
+		t.Errorf("The recipients of the base msg should be removed:\n%s", got[0])
+	}
+}
+
+func TestSendError(t *testing.T) {
+	mg, err := New(getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	s := send.SendFunc(func(from string, to []string, m io.WriterTo) error {
+		n++
+		return errors.New("fail")
+	})
+
+	i := 0
+	src := SourceFunc(func() (*Recipient, error) {
+		i++
+		if i > 2 {
+			return nil, io.EOF
+		}
+		return &Recipient{Address: "bob@example.com"}, nil
+	})
+
+	err = mg.Send(s, src)
+	if err == nil || err.Error() != `gomail: could not send email to "bob@example.com": fail` {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Send should stop at the first error, got %d calls", n)
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	m := getTestMessage()
+	m.SetHeader("Subject", "{{.Name")
+	if _, err := New(m); err == nil {
+		t.Error("New should fail with an invalid template")
+	}
+}
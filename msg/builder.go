@@ -0,0 +1,185 @@
+package msg
+
+import (
+	"io"
+	"time"
+)
+
+// A Builder composes a msg with a fluent API:
+//
+//	s := msg.NewBuilder().
+//		From("alex@example.com", "Alex").
+//		To("bob@example.com").
+//		Subject("Hello!").
+//		Body("text/plain", "Hello Bob!").
+//		Build()
+//
+// A Builder must not be used concurrently. The Snapshot it builds can.
+type Builder struct {
+	m *Message
+}
+
+// NewBuilder creates a new Builder. The settings are the same than the ones of
+// NewMessage.
+func NewBuilder(settings ...MessageSetting) *Builder {
+	return &Builder{m: NewMessage(settings...)}
+}
+
+// Header sets a value to the given header field.
+func (b *Builder) Header(field string, value ...string) *Builder {
+	b.m.SetHeader(field, value...)
+	return b
+}
+
+// AddressHeader sets an address to the given header field.
+func (b *Builder) AddressHeader(field, address, name string) *Builder {
+	b.m.SetAddressHeader(field, address, name)
+	return b
+}
+
+// DateHeader sets a date to the given header field.
+func (b *Builder) DateHeader(field string, date time.Time) *Builder {
+	b.m.SetDateHeader(field, date)
+	return b
+}
+
+// From sets the From header field.
+func (b *Builder) From(address, name string) *Builder {
+	return b.AddressHeader("From", address, name)
+}
+
+// To sets the To header field.
+func (b *Builder) To(address ...string) *Builder {
+	return b.Header("To", address...)
+}
+
+// Cc sets the Cc header field.
+func (b *Builder) Cc(address ...string) *Builder {
+	return b.Header("Cc", address...)
+}
+
+// Bcc sets the Bcc header field.
+func (b *Builder) Bcc(address ...string) *Builder {
+	return b.Header("Bcc", address...)
+}
+
+// Subject sets the Subject header field.
+func (b *Builder) Subject(subject string) *Builder {
+	return b.Header("Subject", subject)
+}
+
+// Body sets the body of the msg. See Message.SetBody.
+func (b *Builder) Body(contentType, body string, settings ...PartSetting) *Builder {
+	b.m.SetBody(contentType, body, settings...)
+	return b
+}
+
+// Alternative adds an alternative part to the msg. See Message.AddAlternative.
+func (b *Builder) Alternative(contentType, body string, settings ...PartSetting) *Builder {
+	b.m.AddAlternative(contentType, body, settings...)
+	return b
+}
+
+// AlternativeWriter adds an alternative part to the msg. See
+// Message.AddAlternativeWriter. f may be called concurrently when the Snapshot
+// is written concurrently.
+func (b *Builder) AlternativeWriter(contentType string, f func(io.Writer) error, settings ...PartSetting) *Builder {
+	b.m.AddAlternativeWriter(contentType, f, settings...)
+	return b
+}
+
+// Attach attaches the file to the msg.
+func (b *Builder) Attach(filename string, settings ...FileSetting) *Builder {
+	b.m.Attach(filename, settings...)
+	return b
+}
+
+// Embed embeds the image in the msg. Use the EmbedImages part setting or the
+// SetHeader file setting to reference it from the HTML body.
+func (b *Builder) Embed(filename string, settings ...FileSetting) *Builder {
+	b.m.Embed(filename, settings...)
+	return b
+}
+
+// Build returns a Snapshot of the msg built so far. The Builder can still be
+// used afterwards, it does not modify the returned Snapshot.
+func (b *Builder) Build() *Snapshot {
+	return &Snapshot{m: b.m.Clone()}
+}
+
+// A Snapshot is an immutable msg. It is safe to write it or send it from
+// several goroutines at the same time.
+//
+// The With methods return a modified copy of the Snapshot, for example to
+// change the recipients or the greeting of a msg sent to several people.
+type Snapshot struct {
+	m *Message
+}
+
+// Message returns a copy of the msg that can be modified.
+func (s *Snapshot) Message() *Message {
+	return s.m.Clone()
+}
+
+// GetHeader gets a header field.
+func (s *Snapshot) GetHeader(field string) []string {
+	return s.m.GetHeader(field)
+}
+
+// GetFrom returns the address of the sender of the msg.
+func (s *Snapshot) GetFrom() (string, error) {
+	return s.m.GetFrom()
+}
+
+// GetRecipients returns the addresses of the recipients of the msg.
+func (s *Snapshot) GetRecipients() ([]string, error) {
+	return s.m.GetRecipients()
+}
+
+// WriteTo implements io.WriterTo. It dumps the whole msg into w.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.m.WriteTo(w)
+}
+
+// WriteBinaryTo dumps the whole msg into w using the binary transfer encoding
+// for the files, see Message.WriteBinaryTo.
+func (s *Snapshot) WriteBinaryTo(w io.Writer) (int64, error) {
+	return s.m.WriteBinaryTo(w)
+}
+
+func (s *Snapshot) with(f func(m *Message)) *Snapshot {
+	m := s.m.Clone()
+	f(m)
+	return &Snapshot{m: m}
+}
+
+// WithHeader returns a copy of the Snapshot with a value set to the given
+// header field.
+func (s *Snapshot) WithHeader(field string, value ...string) *Snapshot {
+	return s.with(func(m *Message) {
+		m.SetHeader(field, value...)
+	})
+}
+
+// WithAddressHeader returns a copy of the Snapshot with an address set to the
+// given header field.
+func (s *Snapshot) WithAddressHeader(field, address, name string) *Snapshot {
+	return s.with(func(m *Message) {
+		m.SetAddressHeader(field, address, name)
+	})
+}
+
+// WithoutHeader returns a copy of the Snapshot without the given header field.
+func (s *Snapshot) WithoutHeader(field string) *Snapshot {
+	return s.with(func(m *Message) {
+		m.DelHeader(field)
+	})
+}
+
+// WithBody returns a copy of the Snapshot with the given body. It replaces all
+// the body parts of the msg, see Message.SetBody.
+func (s *Snapshot) WithBody(contentType, body string, settings ...PartSetting) *Snapshot {
+	return s.with(func(m *Message) {
+		m.SetBody(contentType, body, settings...)
+	})
+}
@@ -0,0 +1,137 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sync"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder().
+		From("from@example.com", "Señor From").
+		To("to@example.com").
+		Cc("cc@example.com").
+		Bcc("bcc@example.com").
+		Subject("¡Hola, señor!").
+		Body("text/plain", "Test").
+		Attach(mockCopyFile("/tmp/test.pdf"))
+	s := b.Build()
+
+	b.Subject("Changed").Body("text/plain", "Changed")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com", "cc@example.com", "bcc@example.com"},
+		content: "From: =?UTF-8?q?Se=C3=B1or_From?= <from@example.com>\r\n" +
+			"To: to@example.com\r\n" +
+			"Cc: cc@example.com\r\n" +
+			"Subject: =?UTF-8?q?=C2=A1Hola,_se=C3=B1or!?=\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	err := stubSendMail(t, 1, want)(want.from, want.to, s)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(s.m.Attachments[0].Header) != 0 {
+		t.Errorf("WriteTo should not modify the headers of the attachments, got %v", s.m.Attachments[0].Header)
+	}
+}
+
+func TestSnapshotWith(t *testing.T) {
+	s := NewBuilder().
+		Header("From", "from@example.com").
+		To("to@example.com").
+		Subject("Hello").
+		Body("text/plain", "Hello!").
+		Build()
+
+	bob := s.WithAddressHeader("To", "bob@example.com", "Bob").
+		WithHeader("Subject", "Hello Bob").
+		WithoutHeader("From").
+		WithBody("text/plain", "Hello Bob!")
+
+	if got := s.GetHeader("To"); len(got) != 1 || got[0] != "to@example.com" {
+		t.Errorf("Invalid To of the original Snapshot, got %q", got)
+	}
+	if got := s.GetHeader("Subject"); len(got) != 1 || got[0] != "Hello" {
+		t.Errorf("Invalid Subject of the original Snapshot, got %q", got)
+	}
+	if _, err := s.GetFrom(); err != nil {
+		t.Errorf("Invalid From of the original Snapshot: %v", err)
+	}
+
+	if got := bob.GetHeader("To"); len(got) != 1 || got[0] != `"Bob" <bob@example.com>` {
+		t.Errorf("Invalid To of the derived Snapshot, got %q", got)
+	}
+	if got := bob.GetHeader("From"); got != nil {
+		t.Errorf("Invalid From of the derived Snapshot, got %q", got)
+	}
+
+	m := bob.Message()
+	m.SetHeader("Subject", "Modified")
+	if got := bob.GetHeader("Subject"); got[0] != "Hello Bob" {
+		t.Errorf("Modifying Message() should not modify the Snapshot, got %q", got)
+	}
+}
+
+func TestSnapshotConcurrentWrite(t *testing.T) {
+	s := NewBuilder().
+		From("from@example.com", "Señor From").
+		To("to@example.com").
+		Body("text/plain", "¡Hola, señor!").
+		Embed(mockCopyFile("image.jpg")).
+		Build()
+
+	var want bytes.Buffer
+	if _, err := s.WriteTo(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s := s.WithAddressHeader("To", "to@example.com", "Señor To")
+				var buf bytes.Buffer
+				if _, err := s.WriteTo(&buf); err != nil {
+					t.Error(err)
+					return
+				}
+				if buf.Len() == 0 {
+					t.Error("Empty msg")
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if _, err := s.WriteTo(&buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if buf.Len() != want.Len() {
+				t.Errorf("Invalid msg length, got %d, want %d", buf.Len(), want.Len())
+			}
+		}()
+	}
+	wg.Wait()
+}
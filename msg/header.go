@@ -0,0 +1,197 @@
+package msg
+
+import (
+	"github.com/hacku7/gomail/mime"
+	"net/textproto"
+)
+
+// Header represents the header fields of a msg.
+//
+// Field names are stored in their canonical form and fields are written in
+// the order they were first added. Values are either raw, in which case they
+// are encoded when the msg is written, or already encoded, in which case they
+// are written as is.
+//
+// The zero value is an empty Header ready to use.
+type Header struct {
+	fields []*headerField
+}
+
+type headerField struct {
+	key    string
+	values []headerValue
+}
+
+type headerValue struct {
+	value   string
+	encoded bool
+}
+
+// Field names whose canonical form is not the one returned by
+// textproto.CanonicalMIMEHeaderKey.
+var commonHeaderKeys = map[string]string{
+	"Mime-Version":          "MIME-Version",
+	"Content-Id":            "Content-ID",
+	"Message-Id":            "Message-ID",
+	"Resent-Message-Id":     "Resent-Message-ID",
+	"Content-Md5":           "Content-MD5",
+	"Dkim-Signature":        "DKIM-Signature",
+	"List-Id":               "List-ID",
+	"Arc-Seal":              "ARC-Seal",
+	"Arc-Message-Signature": "ARC-Message-Signature",
+}
+
+// CanonicalHeaderKey returns the canonical format of the header field name
+// key, for example "MIME-Version" for "mime-version".
+func CanonicalHeaderKey(key string) string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if k, ok := commonHeaderKeys[key]; ok {
+		return k
+	}
+	return key
+}
+
+func (h *Header) field(key string) *headerField {
+	key = CanonicalHeaderKey(key)
+	for _, f := range h.fields {
+		if f.key == key {
+			return f
+		}
+	}
+	return nil
+}
+
+func (h *Header) set(key string, encoded bool, values []string) {
+	f := h.field(key)
+	if f == nil {
+		f = &headerField{key: CanonicalHeaderKey(key)}
+		h.fields = append(h.fields, f)
+	}
+
+	f.values = make([]headerValue, len(values))
+	for i, v := range values {
+		f.values[i] = headerValue{value: v, encoded: encoded}
+	}
+}
+
+func (h *Header) add(key string, encoded bool, value string) {
+	f := h.field(key)
+	if f == nil {
+		f = &headerField{key: CanonicalHeaderKey(key)}
+		h.fields = append(h.fields, f)
+	}
+	f.values = append(f.values, headerValue{value: value, encoded: encoded})
+}
+
+// Set sets the header field to the given raw values, replacing any existing
+// values. The values are encoded when the msg is written.
+func (h *Header) Set(key string, value ...string) {
+	h.set(key, false, value)
+}
+
+// SetEncoded sets the header field to the given values, replacing any existing
+// values. The values must already be encoded and are written as is.
+func (h *Header) SetEncoded(key string, value ...string) {
+	h.set(key, true, value)
+}
+
+// Add adds the raw value to the header field. It appends to any existing
+// values.
+func (h *Header) Add(key, value string) {
+	h.add(key, false, value)
+}
+
+// AddEncoded adds the already encoded value to the header field. It appends to
+// any existing values.
+func (h *Header) AddEncoded(key, value string) {
+	h.add(key, true, value)
+}
+
+// Del deletes the header field.
+func (h *Header) Del(key string) {
+	key = CanonicalHeaderKey(key)
+	for i, f := range h.fields {
+		if f.key == key {
+			h.fields = append(h.fields[:i], h.fields[i+1:]...)
+			return
+		}
+	}
+}
+
+// Has reports whether the header field is set, even with no value.
+func (h *Header) Has(key string) bool {
+	return h.field(key) != nil
+}
+
+// Get gets the first value of the header field. It returns "" if there are no
+// values.
+func (h *Header) Get(key string) string {
+	if f := h.field(key); f != nil && len(f.values) > 0 {
+		return f.values[0].value
+	}
+	return ""
+}
+
+// Values returns all the values of the header field, as they were set.
+func (h *Header) Values(key string) []string {
+	f := h.field(key)
+	if f == nil {
+		return nil
+	}
+
+	values := make([]string, len(f.values))
+	for i, v := range f.values {
+		values[i] = v.value
+	}
+	return values
+}
+
+// EncodedValues returns all the values of the header field. The raw values are
+// encoded using the given encoder and charset.
+func (h *Header) EncodedValues(key string, enc mime.MimeEncoder, charset string) []string {
+	f := h.field(key)
+	if f == nil {
+		return nil
+	}
+
+	values := make([]string, len(f.values))
+	for i, v := range f.values {
+		if v.encoded {
+			values[i] = v.value
+		} else {
+			values[i] = enc.Encode(charset, v.value)
+		}
+	}
+	return values
+}
+
+// Keys returns the canonical names of the header fields in the order they were
+// added.
+func (h *Header) Keys() []string {
+	keys := make([]string, len(h.fields))
+	for i, f := range h.fields {
+		keys[i] = f.key
+	}
+	return keys
+}
+
+// Len returns the number of header fields.
+func (h *Header) Len() int {
+	return len(h.fields)
+}
+
+func (h *Header) clone() Header {
+	c := Header{fields: make([]*headerField, len(h.fields))}
+	for i, f := range h.fields {
+		c.fields[i] = &headerField{
+			key:    f.key,
+			values: append([]headerValue(nil), f.values...),
+		}
+	}
+	return c
+}
+
+// Reset deletes all the header fields.
+func (h *Header) Reset() {
+	h.fields = nil
+}
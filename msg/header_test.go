@@ -0,0 +1,118 @@
+package msg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHeaderKey(t *testing.T) {
+	tests := map[string]string{
+		"mime-version": "MIME-Version",
+		"Mime-Version": "MIME-Version",
+		"MIME-VERSION": "MIME-Version",
+		"content-id":   "Content-ID",
+		"message-id":   "Message-ID",
+		"x-custom-key": "X-Custom-Key",
+		"subject":      "Subject",
+	}
+
+	for key, want := range tests {
+		if got := CanonicalHeaderKey(key); got != want {
+			t.Errorf("CanonicalHeaderKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	var h Header
+	h.Set("subject", "Hello")
+	h.Set("TO", "to1@example.com")
+	h.Add("to", "to2@example.com")
+	h.Set("x-empty")
+	h.Set("Mime-Version", "1.0")
+
+	if got, want := h.Keys(), []string{"Subject", "To", "X-Empty", "MIME-Version"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid keys, got %q, want %q", got, want)
+	}
+	if got, want := h.Values("To"), []string{"to1@example.com", "to2@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid values, got %q, want %q", got, want)
+	}
+	if got := h.Get("to"); got != "to1@example.com" {
+		t.Errorf("Invalid value, got %q, want %q", got, "to1@example.com")
+	}
+	if !h.Has("X-Empty") || h.Get("X-Empty") != "" {
+		t.Error("X-Empty should be set with no value")
+	}
+
+	h.Del("mime-version")
+	h.Set("Subject", "Hello again")
+	if got, want := h.Keys(), []string{"Subject", "To", "X-Empty"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid keys, got %q, want %q", got, want)
+	}
+	if h.Has("MIME-Version") || h.Values("MIME-Version") != nil {
+		t.Error("MIME-Version should be deleted")
+	}
+	if got := h.Get("Subject"); got != "Hello again" {
+		t.Errorf("Invalid value, got %q, want %q", got, "Hello again")
+	}
+
+	h.Reset()
+	if h.Len() != 0 {
+		t.Errorf("Invalid length after reset, got %d, want 0", h.Len())
+	}
+}
+
+func TestHeaderEncodedValues(t *testing.T) {
+	m := NewMessage()
+	m.Header.Set("Subject", "Café")
+	m.Header.Add("Subject", "=?UTF-8?q?Caf=C3=A9?=")
+	m.Header.AddEncoded("Subject", "=?UTF-8?q?Caf=C3=A9?= ¡")
+
+	got := m.Header.EncodedValues("Subject", m.HEncoder, m.Charset)
+	want := []string{
+		"=?UTF-8?q?Caf=C3=A9?=",
+		"=?UTF-8?q?Caf=C3=A9?=",
+		"=?UTF-8?q?Caf=C3=A9?= ¡",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid encoded values, got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("Subject", "Hello")
+	m.SetHeader("from", "from@example.com")
+	m.SetHeader("to", "to@example.com")
+	m.AddHeader("TO", "to2@example.com")
+	m.SetHeader("X-Deleted", "foo")
+	m.Header.Set("X-Raw", "Café")
+	m.SetHeader("Mime-Version", "1.0")
+	m.SetDateHeader("Date", Now())
+	m.DelHeader("x-deleted")
+	m.SetBody("text/plain", "Test")
+
+	wantHeader := "Subject: Hello\r\n" +
+		"From: from@example.com\r\n" +
+		"To: to@example.com, to2@example.com\r\n" +
+		"X-Raw: =?UTF-8?q?Caf=C3=A9?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n"
+	want := wantHeader +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Test"
+
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if !strings.HasPrefix(got, wantHeader) {
+		t.Errorf("Invalid header order, got:\n%s\nwant:\n%s", got, want)
+	}
+	CompareBodies(t, got, want)
+}
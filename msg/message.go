@@ -2,21 +2,24 @@ package msg
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/hacku7/gomail/mime"
-	"github.com/hacku7/gomail/writer"
 	"io"
 	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
-type Header map[string][]string
-
 // Encoding represents a MIME encoding scheme like quoted-printable or base64.
 type Encoding string
 
@@ -29,12 +32,31 @@ const (
 	// Unencoded can be used to avoid encoding the body of an email. The headers
 	// will still be encoded using quoted-printable encoding.
 	Unencoded Encoding = "8bit"
+	// Binary can be used to send a body without encoding it at all, not even
+	// as lines. It requires an SMTP server supporting the BINARYMIME extension
+	// defined in RFC 3030.
+	Binary Encoding = "binary"
 )
 
+// Part represents a body part of a msg, for example its plain text or HTML
+// version.
 type Part struct {
 	ContentType string
 	Copier      func(io.Writer) error
 	Encoding    Encoding
+	// Header contains the extra header fields of the part such as
+	// Content-Language, Content-Description or Content-ID. Setting the
+	// Content-Type or Content-Transfer-Encoding fields overrides the ones
+	// generated from ContentType, Params and Encoding. The body is then
+	// encoded with the encoding named by Content-Transfer-Encoding.
+	Header Header
+	// Params contains the extra parameters of the Content-Type field, for
+	// example format=flowed or method=REQUEST. By default, the charset
+	// parameter is set to the charset of the msg.
+	Params map[string]string
+
+	embedDir    string
+	embedImages bool
 }
 
 // Message represents an email.
@@ -46,14 +68,17 @@ type Message struct {
 	Charset     string
 	Encoding    Encoding
 	HEncoder    mime.MimeEncoder
-	Buf         bytes.Buffer
+	// Buf is no longer used.
+	//
+	// Deprecated: FormatAddress uses its own buffer so that it can be called
+	// concurrently.
+	Buf bytes.Buffer
 }
 
 // NewMessage creates a new msg. It uses UTF-8 and quoted-printable encoding
 // by default.
 func NewMessage(settings ...MessageSetting) *Message {
 	m := &Message{
-		Header:   make(Header),
 		Charset:  "UTF-8",
 		Encoding: QuotedPrintable,
 	}
@@ -72,14 +97,63 @@ func NewMessage(settings ...MessageSetting) *Message {
 // Reset resets the msg so it can be reused. The msg keeps its previous
 // settings so it is in the same state that after a call to NewMessage.
 func (m *Message) Reset() {
-	for k := range m.Header {
-		delete(m.Header, k)
-	}
+	m.Header.Reset()
 	m.Parts = nil
 	m.Attachments = nil
 	m.Embedded = nil
 }
 
+// Clone returns a deep copy of the msg. The body and file copy functions are
+// shared between the msg and its copy.
+func (m *Message) Clone() *Message {
+	c := &Message{
+		Header:   m.Header.clone(),
+		Charset:  m.Charset,
+		Encoding: m.Encoding,
+		HEncoder: m.HEncoder,
+	}
+
+	if m.Parts != nil {
+		c.Parts = make([]*Part, len(m.Parts))
+		for i, p := range m.Parts {
+			c.Parts[i] = p.clone()
+		}
+	}
+	c.Attachments = cloneFiles(m.Attachments)
+	c.Embedded = cloneFiles(m.Embedded)
+
+	return c
+}
+
+func (p *Part) clone() *Part {
+	c := *p
+	c.Header = p.Header.clone()
+	if p.Params != nil {
+		c.Params = make(map[string]string, len(p.Params))
+		for k, v := range p.Params {
+			c.Params[k] = v
+		}
+	}
+	return &c
+}
+
+func cloneFiles(files []*File) []*File {
+	if files == nil {
+		return nil
+	}
+
+	c := make([]*File, len(files))
+	for i, f := range files {
+		cf := *f
+		cf.Header = make(map[string][]string, len(f.Header))
+		for k, v := range f.Header {
+			cf.Header[k] = append([]string(nil), v...)
+		}
+		c[i] = &cf
+	}
+	return c
+}
+
 func (m *Message) applySettings(settings []MessageSetting) {
 	for _, s := range settings {
 		s(m)
@@ -106,14 +180,26 @@ func SetEncoding(enc Encoding) MessageSetting {
 
 // SetHeader sets a value to the given header field.
 func (m *Message) SetHeader(field string, value ...string) {
-	m.encodeHeader(value)
-	m.Header[field] = value
+	m.Header.SetEncoded(field, m.encodeHeader(value)...)
+}
+
+// AddHeader adds a value to the given header field. It appends to any existing
+// values.
+func (m *Message) AddHeader(field, value string) {
+	m.Header.AddEncoded(field, m.encodeString(value))
+}
+
+// DelHeader deletes the given header field.
+func (m *Message) DelHeader(field string) {
+	m.Header.Del(field)
 }
 
-func (m *Message) encodeHeader(values []string) {
+func (m *Message) encodeHeader(values []string) []string {
+	encoded := make([]string, len(values))
 	for i := range values {
-		values[i] = m.encodeString(values[i])
+		encoded[i] = m.encodeString(values[i])
 	}
+	return encoded
 }
 
 func (m *Message) encodeString(value string) string {
@@ -129,7 +215,7 @@ func (m *Message) SetHeaders(h map[string][]string) {
 
 // SetAddressHeader sets an address to the given header field.
 func (m *Message) SetAddressHeader(field, address, name string) {
-	m.Header[field] = []string{m.FormatAddress(address, name)}
+	m.Header.SetEncoded(field, m.FormatAddress(address, name))
 }
 
 // FormatAddress formats an address and a name as a valid RFC 5322 address.
@@ -138,29 +224,28 @@ func (m *Message) FormatAddress(address, name string) string {
 		return address
 	}
 
+	var buf bytes.Buffer
 	enc := m.encodeString(name)
 	if enc == name {
-		m.Buf.WriteByte('"')
+		buf.WriteByte('"')
 		for i := 0; i < len(name); i++ {
 			b := name[i]
 			if b == '\\' || b == '"' {
-				m.Buf.WriteByte('\\')
+				buf.WriteByte('\\')
 			}
-			m.Buf.WriteByte(b)
+			buf.WriteByte(b)
 		}
-		m.Buf.WriteByte('"')
+		buf.WriteByte('"')
 	} else if hasSpecials(name) {
-		m.Buf.WriteString(mime.BEncoding.Encode(m.Charset, name))
+		buf.WriteString(mime.BEncoding.Encode(m.Charset, name))
 	} else {
-		m.Buf.WriteString(enc)
+		buf.WriteString(enc)
 	}
-	m.Buf.WriteString(" <")
-	m.Buf.WriteString(address)
-	m.Buf.WriteByte('>')
+	buf.WriteString(" <")
+	buf.WriteString(address)
+	buf.WriteByte('>')
 
-	addr := m.Buf.String()
-	m.Buf.Reset()
-	return addr
+	return buf.String()
 }
 
 func hasSpecials(text string) bool {
@@ -176,7 +261,7 @@ func hasSpecials(text string) bool {
 
 // SetDateHeader sets a date to the given header field.
 func (m *Message) SetDateHeader(field string, date time.Time) {
-	m.Header[field] = []string{m.FormatDate(date)}
+	m.Header.SetEncoded(field, m.FormatDate(date))
 }
 
 // FormatDate formats a date as a valid RFC 5322 date.
@@ -186,7 +271,7 @@ func (m *Message) FormatDate(date time.Time) string {
 
 // GetHeader gets a header field.
 func (m *Message) GetHeader(field string) []string {
-	return m.Header[field]
+	return m.Header.Values(field)
 }
 
 // SetBody sets the body of the msg. It replaces any content previously set
@@ -229,6 +314,10 @@ func (m *Message) newPart(contentType string, f func(io.Writer) error, settings
 		s(p)
 	}
 
+	if p.embedImages {
+		m.embedImages(p)
+	}
+
 	return p
 }
 
@@ -245,10 +334,33 @@ func SetPartEncoding(e Encoding) PartSetting {
 	})
 }
 
+// SetPartHeader sets a header field of the part added to the msg, for example
+// Content-Language, Content-Description or Content-ID. The values are encoded
+// with the charset of the msg.
+func SetPartHeader(field string, value ...string) PartSetting {
+	return PartSetting(func(p *Part) {
+		p.Header.Set(field, value...)
+	})
+}
+
+// SetPartParam sets a parameter of the Content-Type header field of the part
+// added to the msg, for example format=flowed or method=REQUEST. Setting the
+// charset parameter overrides the charset of the msg for this part.
+func SetPartParam(name, value string) PartSetting {
+	return PartSetting(func(p *Part) {
+		if p.Params == nil {
+			p.Params = make(map[string]string)
+		}
+		p.Params[strings.ToLower(name)] = value
+	})
+}
+
 type File struct {
 	Name     string
 	Header   map[string][]string
 	CopyFunc func(w io.Writer) error
+
+	path string
 }
 
 func (f *File) SetHeader(field, value string) {
@@ -294,6 +406,7 @@ func (m *Message) appendFile(list []*File, name string, settings []FileSetting)
 	f := &File{
 		Name:   filepath.Base(name),
 		Header: make(map[string][]string),
+		path:   name,
 		CopyFunc: func(w io.Writer) error {
 			h, err := os.Open(name)
 			if err != nil {
@@ -323,9 +436,154 @@ func (m *Message) Attach(filename string, settings ...FileSetting) {
 	m.Attachments = m.appendFile(m.Attachments, filename, settings)
 }
 
-// Embed embeds the images to the email.
-func (m *Message) Embed(filename string, settings ...FileSetting) {
+// Embed embeds the images to the email and returns the Content-ID of the
+// embedded part, so it can be referenced with a cid: URL in the HTML body.
+//
+// If the Content-ID header is not set with SetHeader, a unique Content-ID is
+// generated from the file name. It only contains characters that can be used
+// as is in a cid: URL.
+func (m *Message) Embed(filename string, settings ...FileSetting) string {
 	m.Embedded = m.appendFile(m.Embedded, filename, settings)
+
+	f := m.Embedded[len(m.Embedded)-1]
+	if _, ok := f.Header["Content-ID"]; !ok {
+		f.SetHeader("Content-ID", "<"+m.newContentID(f.Name)+">")
+	}
+
+	return f.ContentID()
+}
+
+// ContentID returns the Content-ID of the file without the angle brackets.
+func (f *File) ContentID() string {
+	if v, ok := f.Header["Content-ID"]; ok && len(v) > 0 {
+		return strings.TrimSuffix(strings.TrimPrefix(v[0], "<"), ">")
+	}
+	return ""
+}
+
+// newContentID returns a msg-id, as defined in RFC 5322, whose local part is
+// made of the file name and a random string so that it is globally unique as
+// required by RFC 2392.
+func (m *Message) newContentID(name string) string {
+	name = contentIDName(name)
+	ext := filepath.Ext(name)
+	suffix := "." + randomString() + "@" + contentIDDomain
+
+	id := name + suffix
+	for i := 2; m.hasContentID(id); i++ {
+		id = name[:len(name)-len(ext)] + "-" + strconv.Itoa(i) + ext + suffix
+	}
+	return id
+}
+
+// contentIDDomain is the domain of the generated Content-IDs.
+const contentIDDomain = "gomail"
+
+// contentIDName replaces the characters of a file name which are not letters,
+// digits, '-' or '_' by '_', except the dots between its non-empty parts.
+func contentIDName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			continue
+		}
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if r < utf8.RuneSelf && (r == '-' || r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+				return r
+			}
+			return '_'
+		}, part))
+	}
+	if len(parts) == 0 {
+		return "file"
+	}
+	return strings.Join(parts, ".")
+}
+
+// randomString returns a random string of hexadecimal digits. Stubbed out for
+// testing.
+var randomString = func() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (m *Message) hasContentID(id string) bool {
+	for _, f := range m.Embedded {
+		if f.ContentID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// EmbedImages is a part setting that embeds the local images referenced by the
+// src attributes of the img tags of an HTML part, and rewrites these
+// references to cid: URLs. Relative paths are resolved against dir. Each file
+// is embedded only once, even if it is referenced several times or by several
+// parts of the msg.
+//
+// URLs with a scheme such as http:, data: or cid: are left untouched. When
+// used with AddAlternativeWriter, the function is called right away to
+// rewrite its output.
+func EmbedImages(dir string) PartSetting {
+	return PartSetting(func(p *Part) {
+		p.embedDir = dir
+		p.embedImages = true
+	})
+}
+
+var imgSrcRegExp = regexp.MustCompile(`(?i)(<img\b[^>]*?\bsrc\s*=\s*)("[^"]*"|'[^']*')`)
+
+func (m *Message) embedImages(p *Part) {
+	var buf bytes.Buffer
+	if err := p.Copier(&buf); err != nil {
+		p.Copier = func(io.Writer) error { return err }
+		return
+	}
+
+	body := imgSrcRegExp.ReplaceAllStringFunc(buf.String(), func(tag string) string {
+		sub := imgSrcRegExp.FindStringSubmatch(tag)
+		quoted := sub[2]
+		src := quoted[1 : len(quoted)-1]
+		if src == "" || hasURLScheme(src) {
+			return tag
+		}
+
+		path := src
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.embedDir, filepath.FromSlash(path))
+		}
+		return sub[1] + quoted[:1] + "cid:" + url.PathEscape(m.embedOnce(path)) + quoted[:1]
+	})
+	p.Copier = newCopier(body)
+}
+
+func (m *Message) embedOnce(path string) string {
+	for _, f := range m.Embedded {
+		if f.path == path {
+			return f.ContentID()
+		}
+	}
+	return m.Embed(path)
+}
+
+func hasURLScheme(src string) bool {
+	if strings.HasPrefix(src, "//") {
+		return true
+	}
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == ':':
+			// A single letter followed by a colon is a Windows drive.
+			return i > 1
+		case c == '/' || c == '\\':
+			return false
+		}
+	}
+	return false
 }
 
 func (m *Message) HasMixedPart() bool {
@@ -342,15 +600,25 @@ func (m *Message) HasAlternativePart() bool {
 
 // WriteTo implements io.WriterTo. It dumps the whole msg into w.
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
-	mw := &writer.MessageWriter{W: w}
+	mw := &MessageWriter{W: w}
+	mw.WriteMessage(m)
+	return mw.N, mw.Err
+}
+
+// WriteBinaryTo is like WriteTo but the attachments and embedded files use the
+// binary transfer encoding instead of base64, which makes the msg about 25%
+// smaller. It is used by smtp.Dialer when the server supports the BINARYMIME
+// extension.
+func (m *Message) WriteBinaryTo(w io.Writer) (int64, error) {
+	mw := &MessageWriter{W: w, Binary: true}
 	mw.WriteMessage(m)
 	return mw.N, mw.Err
 }
 
 func (m *Message) GetFrom() (string, error) {
-	from := m.Header["Sender"]
+	from := m.Header.Values("Sender")
 	if len(from) == 0 {
-		from = m.Header["From"]
+		from = m.Header.Values("From")
 		if len(from) == 0 {
 			return "", errors.New(`gomail: invalid msg, "From" field is absent`)
 		}
@@ -362,21 +630,17 @@ func (m *Message) GetFrom() (string, error) {
 func (m *Message) GetRecipients() ([]string, error) {
 	n := 0
 	for _, field := range []string{"To", "Cc", "Bcc"} {
-		if addresses, ok := m.Header[field]; ok {
-			n += len(addresses)
-		}
+		n += len(m.Header.Values(field))
 	}
 	list := make([]string, 0, n)
 
 	for _, field := range []string{"To", "Cc", "Bcc"} {
-		if addresses, ok := m.Header[field]; ok {
-			for _, a := range addresses {
-				addr, err := parseAddress(a)
-				if err != nil {
-					return nil, err
-				}
-				list = addAddress(list, addr)
+		for _, a := range m.Header.Values(field) {
+			addr, err := parseAddress(a)
+			if err != nil {
+				return nil, err
 			}
+			list = addAddress(list, addr)
 		}
 	}
 
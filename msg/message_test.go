@@ -3,8 +3,6 @@ package msg
 import (
 	"bytes"
 	"encoding/base64"
-	"github.com/hacku7/gomail/send"
-	"github.com/hacku7/gomail/writer"
 	"io"
 	"io/ioutil"
 	"path/filepath"
@@ -16,9 +14,10 @@ import (
 )
 
 func init() {
-	writer.Now = func() time.Time {
+	Now = func() time.Time {
 		return time.Date(2014, 06, 25, 17, 46, 0, 0, time.UTC)
 	}
+	randomString = func() string { return "1234" }
 }
 
 type message struct {
@@ -33,8 +32,8 @@ func TestMessage(t *testing.T) {
 	m.SetHeader("To", m.FormatAddress("to@example.com", "Señor To"), "tobis@example.com")
 	m.SetAddressHeader("Cc", "cc@example.com", "A, B")
 	m.SetAddressHeader("X-To", "ccbis@example.com", "à, b")
-	m.SetDateHeader("X-Date", writer.Now())
-	m.SetHeader("X-Date-2", m.FormatDate(writer.Now()))
+	m.SetDateHeader("X-Date", Now())
+	m.SetHeader("X-Date-2", m.FormatDate(Now()))
 	m.SetHeader("Subject", "¡Hola, señor!")
 	m.SetHeaders(map[string][]string{
 		"X-Headers": {"Test", "Café"},
@@ -202,6 +201,71 @@ func TestPartSetting(t *testing.T) {
 	testMessage(t, m, 1, want)
 }
 
+func TestPartHeaders(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "¡Hola, señor!",
+		SetPartParam("format", "flowed"),
+		SetPartParam("DelSp", "yes"),
+		SetPartHeader("Content-Language", "es"),
+		SetPartHeader("Content-Description", "Versión de texto"),
+	)
+	m.AddAlternative("text/calendar", "BEGIN:VCALENDAR",
+		SetPartParam("method", "REQUEST"),
+		SetPartParam("charset", "US-ASCII"),
+		SetPartParam("name", "invite.ics"),
+		SetPartHeader("content-id", "<invite@example.com>"),
+		SetPartHeader("Content-Transfer-Encoding", "7bit"),
+	)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; delsp=yes; format=flowed; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Language: es\r\n" +
+			"Content-Description: =?UTF-8?q?Versi=C3=B3n_de_texto?=\r\n" +
+			"\r\n" +
+			"=C2=A1Hola, se=C3=B1or!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/calendar; method=REQUEST; name=invite.ics; charset=US-ASCII\r\n" +
+			"Content-Transfer-Encoding: 7bit\r\n" +
+			"Content-ID: <invite@example.com>\r\n" +
+			"\r\n" +
+			"BEGIN:VCALENDAR\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestPartTransferEncodingHeader(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "héllo", SetPartHeader("Content-Transfer-Encoding", "Base64"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: Base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("héllo")),
+	}
+
+	testMessage(t, m, 0, want)
+}
+
 func TestBodyWriter(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
@@ -429,7 +493,7 @@ func TestEmbedded(t *testing.T) {
 			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: image/jpeg; name=\"image2.jpg\"\r\n" +
 			"Content-Disposition: inline; filename=\"image2.jpg\"\r\n" +
-			"Content-ID: <image2.jpg>\r\n" +
+			"Content-ID: <image2.jpg.1234@gomail>\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
 			base64.StdEncoding.EncodeToString([]byte("Content of image2.jpg")) + "\r\n" +
@@ -439,6 +503,173 @@ func TestEmbedded(t *testing.T) {
 	testMessage(t, m, 1, want)
 }
 
+func TestEmbedContentID(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	cid1 := m.Embed(mockCopyFile("/tmp/a/image.jpg"))
+	cid2 := m.Embed(mockCopyFile("/tmp/b/image.jpg"))
+	cid3 := m.Embed(mockCopyFileWithHeader(m, "other.jpg", map[string][]string{"Content-ID": {"<foo@bar.mail>"}}))
+	m.SetBody("text/html", `<img src="cid:`+cid1+`">`+"\r\n"+`<img src="cid:`+cid2+`">`)
+
+	if cid1 != "image.jpg.1234@gomail" {
+		t.Errorf("Invalid Content-ID, got %q, want %q", cid1, "image.jpg.1234@gomail")
+	}
+	if cid2 != "image-2.jpg.1234@gomail" {
+		t.Errorf("Invalid Content-ID, got %q, want %q", cid2, "image-2.jpg.1234@gomail")
+	}
+	if cid3 != "foo@bar.mail" {
+		t.Errorf("Invalid Content-ID, got %q, want %q", cid3, "foo@bar.mail")
+	}
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:image.jpg.1234@gomail\">\r\n" +
+			"<img src=3D\"cid:image-2.jpg.1234@gomail\">\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <image.jpg.1234@gomail>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <image-2.jpg.1234@gomail>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/jpeg; name=\"other.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"other.jpg\"\r\n" +
+			"Content-ID: <foo@bar.mail>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of other.jpg")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestEmbedImages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"logo.png", "photo.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("Content of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AddAlternative("text/html", `<img src="logo.png">`+"\r\n"+
+		`<IMG alt='x' SRC='photo.jpg'>`+"\r\n"+
+		`<img src="logo.png">`+"\r\n"+
+		`<img src="http://example.com/a.png">`+"\r\n"+
+		`<img src="cid:foo">`,
+		EmbedImages(dir))
+
+	if len(m.Embedded) != 2 {
+		t.Fatalf("Invalid embedded file count, got %d, want 2", len(m.Embedded))
+	}
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:logo.png.1234@gomail\">\r\n" +
+			"<IMG alt=3D'x' SRC=3D'cid:photo.jpg.1234@gomail'>\r\n" +
+			"<img src=3D\"cid:logo.png.1234@gomail\">\r\n" +
+			"<img src=3D\"http://example.com/a.png\">\r\n" +
+			"<img src=3D\"cid:foo\">\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/png; name=\"logo.png\"\r\n" +
+			"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+			"Content-ID: <logo.png.1234@gomail>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of logo.png")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/jpeg; name=\"photo.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"photo.jpg\"\r\n" +
+			"Content-ID: <photo.jpg.1234@gomail>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of photo.jpg")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 2, want)
+}
+
+func TestEmbedImagesEscape(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "my photo.png")
+	if err := ioutil.WriteFile(path, []byte("Content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMessage()
+	m.Embed(path, SetHeader(map[string][]string{"Content-ID": {"<a b@example.com>"}}))
+	m.SetBody("text/html", `<img src="my photo.png">`, EmbedImages(dir))
+
+	var buf bytes.Buffer
+	if err := m.Parts[0].Copier(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<img src="cid:a%20b@example.com">`; buf.String() != want {
+		t.Errorf("Invalid body, got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestContentIDName(t *testing.T) {
+	tests := map[string]string{
+		"image.jpg":    "image.jpg",
+		"my photo.png": "my_photo.png",
+		"café.jpg":     "caf_.jpg",
+		"a..b.":        "a.b",
+		"<x@y>.gif":    "_x_y_.gif",
+		"...":          "file",
+	}
+	for name, want := range tests {
+		if got := contentIDName(name); got != want {
+			t.Errorf("contentIDName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
 func TestFullMessage(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
@@ -479,7 +710,7 @@ func TestFullMessage(t *testing.T) {
 			"--_BOUNDARY_2_\r\n" +
 			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
 			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
-			"Content-ID: <image.jpg>\r\n" +
+			"Content-ID: <image.jpg.1234@gomail>\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
 			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
@@ -566,6 +797,67 @@ func TestBase64LineLength(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestWriteBinary(t *testing.T) {
+	const content = "\x00\xff\r\n.\r\nfoo"
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+	m.Attach("test.bin", SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	}))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteBinaryTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	boundary := getBoundaries(t, 1, got)[0]
+	want := "MIME-Version: 1.0\r\n" +
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
+		"From: from@example.com\r\n" +
+		"Content-Type: multipart/mixed;\r\n" +
+		" boundary=" + boundary + "\r\n" +
+		"\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Test\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: attachment; filename=\"test.bin\"\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"Content-Type: application/octet-stream; name=\"test.bin\"\r\n" +
+		"\r\n" +
+		content + "\r\n" +
+		"--" + boundary + "--\r\n"
+	if got != want {
+		t.Errorf("Invalid message, got:\n%q\nwant:\n%q", got, want)
+	}
+
+	// A file with a Content-Transfer-Encoding header field keeps its encoding.
+	m.Attach("test.txt", SetHeader(map[string][]string{"Content-Transfer-Encoding": {"base64"}}), SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	}))
+	buf.Reset()
+	if _, err := m.WriteBinaryTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); strings.Count(got, content) != 1 || !strings.Contains(got, base64.StdEncoding.EncodeToString([]byte(content))) {
+		t.Errorf("The file should be encoded in base64, got %q", got)
+	}
+
+	// WriteTo still uses base64.
+	buf.Reset()
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), base64.StdEncoding.EncodeToString([]byte(content))) {
+		t.Errorf("WriteTo should encode the files in base64, got %q", buf.String())
+	}
+}
+
 func TestEmptyName(t *testing.T) {
 	m := NewMessage()
 	m.SetAddressHeader("From", "from@example.com", "")
@@ -594,14 +886,31 @@ func TestEmptyHeader(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+// sendFunc is like send.SendFunc, which cannot be imported since package send
+// imports msg.
+type sendFunc func(from string, to []string, m io.WriterTo) error
+
+// sendMessage is like send.Send with a single email.
+func sendMessage(f sendFunc, m *Message) error {
+	from, err := m.GetFrom()
+	if err != nil {
+		return err
+	}
+	to, err := m.GetRecipients()
+	if err != nil {
+		return err
+	}
+	return f(from, to, m)
+}
+
 func testMessage(t *testing.T, m *Message, bCount int, want *message) {
-	err := send.Send(stubSendMail(t, bCount, want), m)
+	err := sendMessage(stubSendMail(t, bCount, want), m)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-func stubSendMail(t *testing.T, bCount int, want *message) send.SendFunc {
+func stubSendMail(t *testing.T, bCount int, want *message) sendFunc {
 	return func(from string, to []string, m io.WriterTo) error {
 		if from != want.from {
 			t.Fatalf("Invalid from, got %q, want %q", from, want.from)
@@ -627,7 +936,7 @@ func stubSendMail(t *testing.T, bCount int, want *message) send.SendFunc {
 			t.Error(err)
 		}
 		got := buf.String()
-		wantMsg := string("Mime-Version: 1.0\r\n" +
+		wantMsg := string("MIME-Version: 1.0\r\n" +
 			"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
 			want.content)
 		if bCount > 0 {
@@ -671,7 +980,7 @@ func mockCopyFileWithHeader(m *Message, name string, h map[string][]string) (str
 }
 
 func BenchmarkFull(b *testing.B) {
-	discardFunc := send.SendFunc(func(from string, to []string, m io.WriterTo) error {
+	discardFunc := sendFunc(func(from string, to []string, m io.WriterTo) error {
 		_, err := m.WriteTo(ioutil.Discard)
 		return err
 	})
@@ -691,7 +1000,7 @@ func BenchmarkFull(b *testing.B) {
 		m.Attach(mockCopyFile("benchmark.txt"))
 		m.Embed(mockCopyFile("benchmark.jpg"))
 
-		if err := send.Send(discardFunc, m); err != nil {
+		if err := sendMessage(discardFunc, m); err != nil {
 			panic(err)
 		}
 		m.Reset()
@@ -1,26 +1,30 @@
-package writer
+package msg
 
 import (
 	"encoding/base64"
 	"errors"
 	mime1 "github.com/hacku7/gomail/mime"
-	"github.com/hacku7/gomail/msg"
 	"io"
 	"mime"
 	"mime/multipart"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
 
-func (w *MessageWriter) WriteMessage(m *msg.Message) {
-	if _, ok := m.Header["Mime-Version"]; !ok {
-		w.writeString("Mime-Version: 1.0\r\n")
+func (w *MessageWriter) WriteMessage(m *Message) {
+	if !m.Header.Has("MIME-Version") {
+		w.writeString("MIME-Version: 1.0\r\n")
 	}
-	if _, ok := m.Header["Date"]; !ok {
+	if !m.Header.Has("Date") {
 		w.writeHeader("Date", m.FormatDate(Now()))
 	}
-	w.writeHeaders(m.Header)
+	for _, k := range m.Header.Keys() {
+		if k != "Bcc" {
+			w.writeHeader(k, m.Header.EncodedValues(k, m.HEncoder, m.Charset)...)
+		}
+	}
 
 	if m.HasMixedPart() {
 		w.openMultipart("mixed")
@@ -34,7 +38,7 @@ func (w *MessageWriter) WriteMessage(m *msg.Message) {
 		w.openMultipart("alternative")
 	}
 	for _, part := range m.Parts {
-		w.writePart(part, m.Charset)
+		w.writePart(part, m)
 	}
 	if m.HasAlternativePart() {
 		w.closeMultipart()
@@ -58,6 +62,10 @@ type MessageWriter struct {
 	PartWriter io.Writer
 	Depth      uint8
 	Err        error
+	// Binary makes the attachments and embedded files use the binary transfer
+	// encoding instead of base64, unless their Content-Transfer-Encoding
+	// header field is set.
+	Binary bool
 }
 
 func (w *MessageWriter) openMultipart(mimeType string) {
@@ -87,45 +95,118 @@ func (w *MessageWriter) closeMultipart() {
 	}
 }
 
-func (w *MessageWriter) writePart(p *msg.Part, charset string) {
-	w.writeHeaders(map[string][]string{
-		"Content-Type":              {p.ContentType + "; charset=" + charset},
-		"Content-Transfer-Encoding": {string(p.Encoding)},
-	})
-	w.writeBody(p.Copier, p.Encoding)
+func (w *MessageWriter) writePart(p *Part, m *Message) {
+	var h Header
+	if !p.Header.Has("Content-Type") {
+		h.SetEncoded("Content-Type", partContentType(p, m.Charset))
+	}
+	enc := p.Encoding
+	if p.Header.Has("Content-Transfer-Encoding") {
+		enc = transferEncoding(p.Header.Get("Content-Transfer-Encoding"))
+	} else {
+		h.SetEncoded("Content-Transfer-Encoding", string(enc))
+	}
+	for _, k := range p.Header.Keys() {
+		h.SetEncoded(k, p.Header.EncodedValues(k, m.HEncoder, m.Charset)...)
+	}
+
+	w.writeOrderedHeaders(&h)
+	w.writeBody(p.Copier, enc)
+}
+
+// transferEncoding returns the encoding of a body whose
+// Content-Transfer-Encoding header field is set to value. The identity
+// encodings 7bit and 8bit, and the unknown ones, leave the body unencoded.
+func transferEncoding(value string) Encoding {
+	switch enc := Encoding(strings.ToLower(strings.TrimSpace(value))); enc {
+	case QuotedPrintable, Base64, Binary:
+		return enc
+	}
+	return Unencoded
 }
 
-func (w *MessageWriter) addFiles(files []*msg.File, isAttachment bool) {
+func partContentType(p *Part, charset string) string {
+	contentType := p.ContentType
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		params = nil
+	}
+
+	names := make([]string, 0, len(p.Params))
+	for k := range p.Params {
+		if _, ok := params[k]; !ok && k != "charset" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		contentType += formatParam(k, p.Params[k])
+	}
+
+	if _, ok := params["charset"]; !ok {
+		if c, ok := p.Params["charset"]; ok {
+			charset = c
+		}
+		contentType += formatParam("charset", charset)
+	}
+
+	return contentType
+}
+
+// formatParam formats a Content-Type parameter, quoting or encoding its value
+// as defined in RFC 2045 and RFC 2231 when needed.
+func formatParam(name, value string) string {
+	const mediaType = "x/x"
+	if s := mime.FormatMediaType(mediaType, map[string]string{name: value}); s != "" {
+		return s[len(mediaType):]
+	}
+	return "; " + name + "=" + value
+}
+
+func (w *MessageWriter) addFiles(files []*File, isAttachment bool) {
 	for _, f := range files {
-		if _, ok := f.Header["Content-Type"]; !ok {
+		// The headers of the file are copied so that writing a msg never
+		// modifies it and the same msg can be written concurrently.
+		h := make(map[string][]string, len(f.Header)+4)
+		for k, v := range f.Header {
+			h[k] = v
+		}
+
+		if _, ok := h["Content-Type"]; !ok {
 			mediaType := mime.TypeByExtension(filepath.Ext(f.Name))
 			if mediaType == "" {
 				mediaType = "application/octet-stream"
 			}
-			f.SetHeader("Content-Type", mediaType+`; name="`+f.Name+`"`)
+			h["Content-Type"] = []string{mediaType + `; name="` + f.Name + `"`}
 		}
 
-		if _, ok := f.Header["Content-Transfer-Encoding"]; !ok {
-			f.SetHeader("Content-Transfer-Encoding", string(msg.Base64))
+		enc := Base64
+		if v, ok := h["Content-Transfer-Encoding"]; ok && len(v) > 0 {
+			enc = transferEncoding(v[0])
+		} else {
+			if w.Binary {
+				enc = Binary
+			}
+			h["Content-Transfer-Encoding"] = []string{string(enc)}
 		}
 
-		if _, ok := f.Header["Content-Disposition"]; !ok {
+		if _, ok := h["Content-Disposition"]; !ok {
 			var disp string
 			if isAttachment {
 				disp = "attachment"
 			} else {
 				disp = "inline"
 			}
-			f.SetHeader("Content-Disposition", disp+`; filename="`+f.Name+`"`)
+			h["Content-Disposition"] = []string{disp + `; filename="` + f.Name + `"`}
 		}
 
 		if !isAttachment {
-			if _, ok := f.Header["Content-ID"]; !ok {
-				f.SetHeader("Content-ID", "<"+f.Name+">")
+			if _, ok := h["Content-ID"]; !ok {
+				h["Content-ID"] = []string{"<" + f.Name + ">"}
 			}
 		}
-		w.writeHeaders(f.Header)
-		w.writeBody(f.CopyFunc, msg.Base64)
+		w.writeHeaders(h)
+		w.writeBody(f.CopyFunc, enc)
 	}
 }
 
@@ -221,6 +302,20 @@ func (w *MessageWriter) writeLine(s string, charsLeft int) string {
 	return ""
 }
 
+func (w *MessageWriter) writeOrderedHeaders(h *Header) {
+	if w.Depth == 0 {
+		for _, k := range h.Keys() {
+			w.writeHeader(k, h.Values(k)...)
+		}
+	} else {
+		mh := make(map[string][]string, h.Len())
+		for _, k := range h.Keys() {
+			mh[k] = h.Values(k)
+		}
+		w.createPart(mh)
+	}
+}
+
 func (w *MessageWriter) writeHeaders(h map[string][]string) {
 	if w.Depth == 0 {
 		for k, v := range h {
@@ -233,7 +328,7 @@ func (w *MessageWriter) writeHeaders(h map[string][]string) {
 	}
 }
 
-func (w *MessageWriter) writeBody(f func(io.Writer) error, enc msg.Encoding) {
+func (w *MessageWriter) writeBody(f func(io.Writer) error, enc Encoding) {
 	var subWriter io.Writer
 	if w.Depth == 0 {
 		w.writeString("\r\n")
@@ -242,11 +337,11 @@ func (w *MessageWriter) writeBody(f func(io.Writer) error, enc msg.Encoding) {
 		subWriter = w.PartWriter
 	}
 
-	if enc == msg.Base64 {
+	if enc == Base64 {
 		wc := base64.NewEncoder(base64.StdEncoding, newBase64LineWriter(subWriter))
 		w.Err = f(wc)
 		wc.Close()
-	} else if enc == msg.Unencoded {
+	} else if enc == Unencoded || enc == Binary {
 		w.Err = f(subWriter)
 	} else {
 		wc := mime1.NewQPWriter(subWriter)
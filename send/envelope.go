@@ -0,0 +1,70 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// An Envelope contains the addresses used by the SMTP server to deliver an
+// email. By default, they are read from the header fields of the email but
+// they can differ, for example to use a VERP return path, to send an email to
+// addresses that are not in its header or to redirect its recipients.
+type Envelope struct {
+	// From is the return path of the email, sent with the MAIL command. The
+	// bounces are sent to it. It can be empty to send a null return path.
+	From string
+	// To contains the recipients of the email, sent with the RCPT command.
+	To []string
+	// MailParams contains extra parameters of the MAIL command, for example
+	// "RET=HDRS".
+	MailParams []string
+	// RcptParams contains extra parameters of the RCPT command, by recipient,
+	// for example "NOTIFY=SUCCESS".
+	RcptParams map[string][]string
+}
+
+// NewEnvelope returns the Envelope of m read from its header fields, see
+// Message.GetFrom and Message.GetRecipients. It can then be modified without
+// modifying m.
+func NewEnvelope(m Mail) (*Envelope, error) {
+	from, err := m.GetFrom()
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := m.GetRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{From: from, To: to}, nil
+}
+
+// EnvelopeSender is the interface implemented by the Senders that support
+// envelope parameters, like the smtp package Senders.
+//
+// SendEnvelope sends an email using the addresses and parameters of env.
+type EnvelopeSender interface {
+	SendEnvelope(ctx context.Context, env *Envelope, msg io.WriterTo) error
+}
+
+// SendEnvelope sends msg using the given Sender and the addresses of env
+// instead of the ones of the header of msg. An error is returned if env has
+// parameters and s is not an EnvelopeSender.
+func SendEnvelope(ctx context.Context, s Sender, env *Envelope, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if es, ok := s.(EnvelopeSender); ok {
+		return es.SendEnvelope(ctx, env, msg)
+	}
+	if len(env.MailParams) > 0 || len(env.RcptParams) > 0 {
+		return errors.New("gomail: the Sender does not support envelope parameters")
+	}
+	if cs, ok := s.(ContextSender); ok {
+		return cs.SendContext(ctx, env.From, env.To, msg)
+	}
+	return s.Send(env.From, env.To, msg)
+}
@@ -0,0 +1,63 @@
+package send
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type mockEnvelopeSender struct {
+	mockSender
+	env *Envelope
+}
+
+func (s *mockEnvelopeSender) SendEnvelope(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	s.env = env
+	return nil
+}
+
+func TestNewEnvelope(t *testing.T) {
+	env, err := NewEnvelope(getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Envelope{From: testFrom, To: []string{testTo1, testTo2}}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Invalid envelope, got %+v, want %+v", env, want)
+	}
+}
+
+func TestSendEnvelope(t *testing.T) {
+	const bounces = "bounces@example.com"
+	env := &Envelope{From: bounces, To: []string{testTo2}}
+	s := stubSend(t, bounces, []string{testTo2}, testMsg)
+
+	if err := SendEnvelope(context.Background(), s, env, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendEnvelopeParams(t *testing.T) {
+	env := &Envelope{
+		From:       testFrom,
+		To:         []string{testTo1},
+		MailParams: []string{"RET=HDRS"},
+	}
+
+	s := mockSender(func(from string, to []string, msg io.WriterTo) error {
+		t.Error("Send should not be called when the parameters are not supported")
+		return nil
+	})
+	if err := SendEnvelope(context.Background(), s, env, getTestMessage()); err == nil {
+		t.Error("SendEnvelope should fail when the Sender does not support the parameters")
+	}
+
+	es := &mockEnvelopeSender{}
+	if err := SendEnvelope(context.Background(), Retry(es, RetryPolicy{}), env, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if es.env != env {
+		t.Errorf("The envelope should be passed to the EnvelopeSender, got %+v", es.env)
+	}
+}
@@ -0,0 +1,185 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Default values of RetryPolicy.
+const (
+	DefaultMaxAttempts = 3
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = 30 * time.Second
+)
+
+// A RetryPolicy defines how sending an email is retried after a transient
+// failure. The zero value is a valid policy using the default values.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// By default, DefaultMaxAttempts.
+	MaxAttempts int
+	// MinBackoff is the time to wait before the first retry. It is doubled
+	// after each attempt, with a random jitter. By default, DefaultMinBackoff.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time to wait between two attempts. By default,
+	// DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// MaxDuration is the maximum time spent retrying, from the start of the
+	// first attempt. No attempt is started after it. By default, there is no
+	// limit other than the deadline of the context.
+	MaxDuration time.Duration
+	// Retryable reports whether an error is transient. By default,
+	// IsTemporary is used.
+	Retryable func(error) bool
+}
+
+// IsTemporary reports whether err is a transient failure which may not happen
+// again: a 4xx reply of the SMTP server, a timeout or a broken connection. The
+// errors of a done context are not transient.
+func IsTemporary(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || isDeadlineExceeded(err) {
+		return false
+	}
+
+	var t interface{ IsTemporary() bool }
+	if errors.As(err, &t) {
+		return t.IsTemporary()
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isDeadlineExceeded reports whether err wraps context.DeadlineExceeded itself.
+// errors.Is is not used since the network timeouts also match it, although
+// they happen before the deadline of the context.
+func isDeadlineExceeded(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err == context.DeadlineExceeded {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls f until it succeeds, it returns an error that is not transient, the
+// maximum number of attempts or the maximum duration is reached, or ctx is
+// done. It returns the error of the last call to f.
+func (p RetryPolicy) Do(ctx context.Context, f func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !p.retryable(err) || attempt >= p.maxAttempts() {
+			return err
+		}
+
+		wait := p.backoff(attempt)
+		next := time.Now().Add(wait)
+		if p.MaxDuration > 0 && next.After(start.Add(p.MaxDuration)) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && next.After(deadline) {
+			return err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTemporary(err)
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the time to wait after the given attempt: half of it is
+// fixed and the other half is random so that concurrent senders do not retry
+// at the same time.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	d := min
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Retry returns a SendCloser sending emails with s and retrying them according
+// to p. Its Close method closes s if it is a SendCloser.
+//
+// s should be left in a usable state after a failure, like the SendCloser
+// returned by smtp.Dialer. Setting the Retry field of smtp.Dialer is an
+// alternative which also resets the SMTP session and redials between attempts.
+func Retry(s Sender, p RetryPolicy) SendCloser {
+	return &retrySender{s: s, p: p}
+}
+
+type retrySender struct {
+	s Sender
+	p RetryPolicy
+}
+
+func (r *retrySender) Send(from string, to []string, msg io.WriterTo) error {
+	return r.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements ContextSender.
+func (r *retrySender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return r.p.Do(ctx, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if cs, ok := r.s.(ContextSender); ok {
+			return cs.SendContext(ctx, from, to, msg)
+		}
+		return r.s.Send(from, to, msg)
+	})
+}
+
+// SendEnvelope implements EnvelopeSender.
+func (r *retrySender) SendEnvelope(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	return r.p.Do(ctx, func() error {
+		return SendEnvelope(ctx, r.s, env, msg)
+	})
+}
+
+func (r *retrySender) Close() error {
+	if sc, ok := r.s.(SendCloser); ok {
+		return sc.Close()
+	}
+	return nil
+}
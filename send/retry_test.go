@@ -0,0 +1,158 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type temporaryError bool
+
+func (e temporaryError) Error() string     { return "smtp error" }
+func (e temporaryError) IsTemporary() bool { return bool(e) }
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("fail"), false},
+		{temporaryError(true), true},
+		{temporaryError(false), false},
+		{fmt.Errorf("gomail: could not send email 1: %w", temporaryError(true)), true},
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("gomail: could not send email 1: %w", context.DeadlineExceeded), false},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, true},
+	}
+
+	for _, test := range tests {
+		if got := IsTemporary(test.err); got != test.want {
+			t.Errorf("IsTemporary(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetry(t *testing.T) {
+	n := 0
+	s := Retry(mockSender(func(from string, to []string, msg io.WriterTo) error {
+		n++
+		if n < 3 {
+			return temporaryError(true)
+		}
+		return nil
+	}), RetryPolicy{MinBackoff: time.Millisecond})
+
+	if err := s.Send(testFrom, []string{testTo1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Invalid number of attempts, got %d, want 3", n)
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	n := 0
+	s := Retry(mockSender(func(from string, to []string, msg io.WriterTo) error {
+		n++
+		return temporaryError(true)
+	}), RetryPolicy{MaxAttempts: 4, MinBackoff: time.Millisecond})
+
+	if err := s.Send(testFrom, []string{testTo1}, nil); err != temporaryError(true) {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n != 4 {
+		t.Errorf("Invalid number of attempts, got %d, want 4", n)
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	n := 0
+	s := Retry(mockSender(func(from string, to []string, msg io.WriterTo) error {
+		n++
+		return temporaryError(false)
+	}), RetryPolicy{MinBackoff: time.Millisecond})
+
+	s.Send(testFrom, []string{testTo1}, nil)
+	if n != 1 {
+		t.Errorf("A permanent error should not be retried, got %d attempts", n)
+	}
+}
+
+func TestRetryMaxDuration(t *testing.T) {
+	n := 0
+	s := Retry(mockSender(func(from string, to []string, msg io.WriterTo) error {
+		n++
+		return io.EOF
+	}), RetryPolicy{MaxAttempts: 10, MinBackoff: 40 * time.Millisecond, MaxDuration: 50 * time.Millisecond})
+
+	if err := s.Send(testFrom, []string{testTo1}, nil); err != io.EOF {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Invalid number of attempts, got %d, want 2", n)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	s := Retry(mockSender(func(from string, to []string, msg io.WriterTo) error {
+		n++
+		cancel()
+		return io.EOF
+	}), RetryPolicy{MinBackoff: time.Hour})
+
+	start := time.Now()
+	s.(ContextSender).SendContext(ctx, testFrom, []string{testTo1}, nil)
+	if n != 1 || time.Since(start) > time.Second {
+		t.Errorf("Retrying should stop when the context is done, got %d attempts", n)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range []time.Duration{0, 100, 200, 400, 800, 1000, 1000} {
+		if attempt == 0 {
+			continue
+		}
+		max *= time.Millisecond
+		for i := 0; i < 10; i++ {
+			if d := p.backoff(attempt); d < max/2 || d > max {
+				t.Errorf("Invalid backoff after attempt %d, got %v, want between %v and %v", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetryClose(t *testing.T) {
+	closed := false
+	s := Retry(&mockSendCloser{
+		mockSender: func(from string, to []string, msg io.WriterTo) error { return nil },
+		close: func() error {
+			closed = true
+			return nil
+		},
+	}, RetryPolicy{})
+
+	s.Close()
+	if !closed {
+		t.Error("Close() should close the underlying SendCloser")
+	}
+}
@@ -0,0 +1,184 @@
+package send
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// A Route defines the emails and recipients sent with a Sender. The empty
+// conditions match everything.
+type Route struct {
+	// Domains contains patterns of the domains of the recipients, for example
+	// "example.com" or "*.example.com", see path.Match. A recipient matches if
+	// its domain matches one of them.
+	Domains []string
+	// Header maps header fields to patterns of their value, for example
+	// "X-Campaign": "*". An email matches if each field has a value matching
+	// its pattern, once decoded if it contains encoded-words. Only the emails
+	// having a GetHeader method, like *msg.Message and *msg.Snapshot, can
+	// match.
+	Header map[string]string
+	// Tag is the tag of the emails, see WithTag.
+	Tag string
+	// Sender sends the emails to the recipients matching the route, for
+	// example the smtp.Pool of a relay. If it is nil, an error is returned for
+	// these recipients.
+	Sender Sender
+}
+
+// A Router is a Sender choosing the Sender of each recipient of an email
+// according to routes, for example to send the emails to internal domains
+// through one relay and the others through another. The recipients of an
+// email are split across the routes when needed.
+type Router struct {
+	// Routes are tried in order, the first one matching an email and a
+	// recipient is used.
+	Routes []Route
+	// Default is used for the recipients that match no route. If it is nil,
+	// an error is returned for them.
+	Default Sender
+}
+
+type tagKey struct{}
+
+// WithTag returns a copy of ctx which tags the emails sent with it, for
+// example with "bulk" or "transactional", so that Router can choose their
+// route.
+func WithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// Tag returns the tag of the emails sent with ctx, see WithTag.
+func Tag(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+// Send implements Sender.
+func (r *Router) Send(from string, to []string, msg io.WriterTo) error {
+	return r.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements ContextSender.
+func (r *Router) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return r.SendEnvelope(ctx, &Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements EnvelopeSender. If the email cannot be sent with
+// some routes, it is still sent with the others and a RecipientErrors is
+// returned.
+func (r *Router) SendEnvelope(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	// The recipients are grouped by route, the last group is the one of the
+	// default Sender.
+	var order []int
+	recipients := make(map[int][]string)
+	errs := make(RecipientErrors)
+	for _, rcpt := range env.To {
+		i, err := r.route(ctx, rcpt, msg)
+		if err != nil {
+			errs[rcpt] = err
+			continue
+		}
+		if _, ok := recipients[i]; !ok {
+			order = append(order, i)
+		}
+		recipients[i] = append(recipients[i], rcpt)
+	}
+
+	for _, i := range order {
+		s := r.Default
+		if i < len(r.Routes) {
+			s = r.Routes[i].Sender
+		}
+		e := *env
+		e.To = recipients[i]
+		var err error
+		if s == nil {
+			err = fmt.Errorf("gomail: route %d has no Sender", i)
+		} else {
+			err = SendEnvelope(ctx, s, &e, msg)
+		}
+		if err != nil {
+			for _, rcpt := range e.To {
+				errs[rcpt] = err
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// route returns the index of the route of a recipient, or len(r.Routes) if
+// the default Sender is used.
+func (r *Router) route(ctx context.Context, rcpt string, msg io.WriterTo) (int, error) {
+	for i, route := range r.Routes {
+		ok, err := route.match(ctx, rcpt, msg)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+
+	if r.Default == nil {
+		return 0, fmt.Errorf("gomail: no route to %s", rcpt)
+	}
+	return len(r.Routes), nil
+}
+
+func (r *Route) match(ctx context.Context, rcpt string, msg io.WriterTo) (bool, error) {
+	if r.Tag != "" && r.Tag != Tag(ctx) {
+		return false, nil
+	}
+
+	if len(r.Header) > 0 {
+		h, ok := msg.(interface{ GetHeader(string) []string })
+		if !ok {
+			return false, nil
+		}
+		for field, pattern := range r.Header {
+			ok, err := matchAny(pattern, h.GetHeader(field))
+			if !ok || err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if len(r.Domains) == 0 {
+		return true, nil
+	}
+	i := strings.LastIndexByte(rcpt, '@')
+	if i == -1 {
+		return false, nil
+	}
+	domain := strings.ToLower(rcpt[i+1:])
+	for _, pattern := range r.Domains {
+		if ok, err := path.Match(strings.ToLower(pattern), domain); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchAny reports whether one of the values matches pattern. The values are
+// decoded first since the non-ASCII ones are encoded as defined in RFC 2047.
+func matchAny(pattern string, values []string) (bool, error) {
+	dec := new(mime.WordDecoder)
+	for _, v := range values {
+		if s, err := dec.DecodeHeader(v); err == nil {
+			v = s
+		}
+		if ok, err := path.Match(pattern, v); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,131 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordSender records the recipients of the emails it sends.
+type recordSender struct {
+	to  [][]string
+	err error
+}
+
+func (s *recordSender) Send(from string, to []string, msg io.WriterTo) error {
+	s.to = append(s.to, to)
+	return s.err
+}
+
+func TestRouter(t *testing.T) {
+	const (
+		internal = "user@corp.example.com"
+		partner  = "user@partner.example.org"
+	)
+	bulk, corp, relay := &recordSender{}, &recordSender{}, &recordSender{}
+	r := &Router{
+		Routes: []Route{
+			{Tag: "bulk", Sender: bulk},
+			{Domains: []string{"*.EXAMPLE.com"}, Sender: corp},
+		},
+		Default: relay,
+	}
+
+	m := getTestMessage()
+	m.SetHeader("To", internal, partner, testTo1)
+	if err := Send(r, m); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{internal}}; !reflect.DeepEqual(corp.to, want) {
+		t.Errorf("Invalid recipients of the corp route, got %q, want %q", corp.to, want)
+	}
+	if want := [][]string{{partner, testTo1}}; !reflect.DeepEqual(relay.to, want) {
+		t.Errorf("Invalid recipients of the default route, got %q, want %q", relay.to, want)
+	}
+
+	if err := SendContext(WithTag(context.Background(), "bulk"), r, m); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{internal, partner, testTo1}}; !reflect.DeepEqual(bulk.to, want) {
+		t.Errorf("Invalid recipients of the bulk route, got %q, want %q", bulk.to, want)
+	}
+}
+
+func TestRouterHeader(t *testing.T) {
+	campaign, relay := &recordSender{}, &recordSender{}
+	r := &Router{
+		Routes:  []Route{{Header: map[string]string{"X-Campaign": "spring-*"}, Sender: campaign}},
+		Default: relay,
+	}
+
+	m := getTestMessage()
+	if err := Send(r, m); err != nil {
+		t.Fatal(err)
+	}
+	m.SetHeader("X-Campaign", "spring-sale")
+	if err := Send(r, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(campaign.to) != 1 || len(relay.to) != 1 {
+		t.Errorf("Only the email with the header should use the route, got %q and %q", campaign.to, relay.to)
+	}
+
+	// The encoded values are decoded before being matched.
+	m.SetHeader("X-Campaign", "spring-été")
+	if v := m.GetHeader("X-Campaign")[0]; !strings.HasPrefix(v, "=?") {
+		t.Fatalf("The header should be encoded, got %q", v)
+	}
+	r.Routes[0].Header["X-Campaign"] = "spring-été"
+	if err := Send(r, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(campaign.to) != 2 {
+		t.Errorf("The email with the encoded header should use the route, got %q", campaign.to)
+	}
+
+	// An email without header fields cannot match.
+	if err := r.Send(testFrom, []string{testTo1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.to) != 2 {
+		t.Errorf("The email should use the default route, got %q", relay.to)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	failing := &recordSender{err: io.EOF}
+	r := &Router{
+		Routes: []Route{
+			{Domains: []string{"example.org"}, Sender: failing},
+			{Domains: []string{"example.com"}, Sender: SendFunc(func(from string, to []string, msg io.WriterTo) error {
+				return nil
+			})},
+		},
+	}
+
+	err := r.Send(testFrom, []string{"a@example.org", testTo1, "b@example.net"}, nil)
+	var errs RecipientErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Invalid error, got %#v", err)
+	}
+	if errs["a@example.org"] != io.EOF {
+		t.Errorf("Invalid error for the failing route, got %v", errs["a@example.org"])
+	}
+	if errs["b@example.net"] == nil {
+		t.Error("A recipient without route should have an error")
+	}
+
+	r.Routes[0].Sender = nil
+	if err := r.Send(testFrom, []string{"a@example.org"}, nil); !errors.As(err, &errs) || errs["a@example.org"] == nil {
+		t.Errorf("A route without Sender should be reported, got %v", err)
+	}
+
+	r.Routes[0].Domains = []string{"["}
+	if err := r.Send(testFrom, []string{testTo1}, nil); !errors.As(err, &errs) || errs[testTo1] != path.ErrBadPattern {
+		t.Errorf("An invalid pattern should be reported, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package send
 
 import (
+	"context"
 	"fmt"
 	"github.com/hacku7/gomail/msg"
 	"io"
@@ -13,6 +14,15 @@ type Sender interface {
 	Send(from string, to []string, msg io.WriterTo) error
 }
 
+// ContextSender is the interface implemented by the Senders that can be
+// cancelled.
+//
+// SendContext sends an email to the given addresses. It returns as soon as
+// possible once ctx is done.
+type ContextSender interface {
+	SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error
+}
+
 // SendCloser is the interface that groups the Send and Close methods.
 type SendCloser interface {
 	Sender
@@ -31,31 +41,66 @@ func (f SendFunc) Send(from string, to []string, msg io.WriterTo) error {
 	return f(from, to, msg)
 }
 
+// Mail is the interface implemented by the emails that can be sent, such as
+// *msg.Message and *msg.Snapshot.
+type Mail interface {
+	io.WriterTo
+	GetFrom() (string, error)
+	GetRecipients() ([]string, error)
+}
+
 // Send sends emails using the given Sender.
 func Send(s Sender, msg ...*msg.Message) error {
 	for i, m := range msg {
 		if err := send(s, m); err != nil {
-			return fmt.Errorf("gomail: could not send email %d: %v", i+1, err)
+			return fmt.Errorf("gomail: could not send email %d: %w", i+1, err)
 		}
 	}
 
 	return nil
 }
 
-func send(s Sender, m *msg.Message) error {
-	from, err := m.GetFrom()
-	if err != nil {
-		return err
+// SendMail sends emails using the given Sender. Unlike Send, it accepts any
+// Mail, for example a *msg.Snapshot shared by several goroutines.
+func SendMail(s Sender, mail ...Mail) error {
+	for i, m := range mail {
+		if err := send(s, m); err != nil {
+			return fmt.Errorf("gomail: could not send email %d: %w", i+1, err)
+		}
 	}
 
-	to, err := m.GetRecipients()
-	if err != nil {
+	return nil
+}
+
+// SendContext sends emails using the given Sender. If the Sender implements
+// ContextSender, ctx bounds the sending of each email. Otherwise, ctx is only
+// checked between emails.
+func SendContext(ctx context.Context, s Sender, msg ...*msg.Message) error {
+	for i, m := range msg {
+		if err := sendContext(ctx, s, m); err != nil {
+			return fmt.Errorf("gomail: could not send email %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func send(s Sender, m Mail) error {
+	return sendContext(context.Background(), s, m)
+}
+
+func sendContext(ctx context.Context, s Sender, m Mail) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if err := s.Send(from, to, m); err != nil {
+	env, err := NewEnvelope(m)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	if cs, ok := s.(ContextSender); ok {
+		return cs.SendContext(ctx, env.From, env.To, m)
+	}
+	return s.Send(env.From, env.To, m)
 }
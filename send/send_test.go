@@ -6,6 +6,7 @@ import (
 	"io"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -15,7 +16,7 @@ const (
 	testBody = "Test msg"
 	testMsg  = "To: " + testTo1 + ", " + testTo2 + "\r\n" +
 		"From: " + testFrom + "\r\n" +
-		"Mime-Version: 1.0\r\n" +
+		"MIME-Version: 1.0\r\n" +
 		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
 		"Content-Type: text/plain; charset=UTF-8\r\n" +
 		"Content-Transfer-Encoding: quoted-printable\r\n" +
@@ -23,6 +24,12 @@ const (
 		testBody
 )
 
+func init() {
+	msg.Now = func() time.Time {
+		return time.Date(2014, 06, 25, 17, 46, 0, 0, time.UTC)
+	}
+}
+
 type mockSender SendFunc
 
 func (s mockSender) Send(from string, to []string, msg io.WriterTo) error {
@@ -51,6 +58,24 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSendMail(t *testing.T) {
+	s := &mockSendCloser{
+		mockSender: stubSend(t, testFrom, []string{testTo1, testTo2}, testMsg),
+		close: func() error {
+			t.Error("Close() should not be called in SendMail()")
+			return nil
+		},
+	}
+	snapshot := msg.NewBuilder().
+		Header("From", testFrom).
+		To(testTo1, testTo2).
+		Body("text/plain", testBody).
+		Build()
+	if err := SendMail(s, snapshot, getTestMessage()); err != nil {
+		t.Errorf("SendMail(): %v", err)
+	}
+}
+
 func getTestMessage() *msg.Message {
 	m := msg.NewMessage()
 	m.SetHeader("From", testFrom)
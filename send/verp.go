@@ -0,0 +1,124 @@
+package send
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// VERPAddress returns the variable envelope return path (VERP) of rcpt: the
+// recipient is encoded in the local part of returnPath, for example
+// "bounces+user=example.com@example.org" for the recipient "user@example.com"
+// and the return path "bounces@example.org". Use ParseVERP to decode it.
+func VERPAddress(returnPath, rcpt string) (string, error) {
+	i := strings.LastIndexByte(returnPath, '@')
+	if i == -1 || strings.IndexByte(returnPath[:i], '+') != -1 {
+		return "", fmt.Errorf("gomail: invalid VERP return path %q", returnPath)
+	}
+	j := strings.LastIndexByte(rcpt, '@')
+	if j == -1 {
+		return "", fmt.Errorf("gomail: invalid recipient %q", rcpt)
+	}
+
+	return returnPath[:i] + "+" + rcpt[:j] + "=" + rcpt[j+1:] + returnPath[i:], nil
+}
+
+// ParseVERP returns the recipient encoded in a variable envelope return path
+// generated by VERPAddress, typically the address to which a bounce was sent.
+func ParseVERP(addr string) (rcpt string, err error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i == -1 {
+		return "", fmt.Errorf("gomail: invalid VERP address %q", addr)
+	}
+	local := addr[:i]
+	start := strings.IndexByte(local, '+')
+	end := strings.LastIndexByte(local, '=')
+	if start == -1 || end < start+2 || end == len(local)-1 {
+		return "", fmt.Errorf("gomail: invalid VERP address %q", addr)
+	}
+
+	return local[start+1:end] + "@" + local[end+1:], nil
+}
+
+// VERP returns a SendCloser sending an email to each recipient in its own
+// transaction, with the VERP address of the recipient as return path, see
+// VERPAddress. The return path of the emails is ignored. Its Close method
+// closes s if it is a SendCloser.
+//
+// If the email cannot be sent to some recipients, it is still sent to the
+// others and a RecipientErrors is returned. To retry the failed transactions,
+// use a Sender returned by Retry as s rather than wrapping the VERP Sender.
+func VERP(s Sender, returnPath string) SendCloser {
+	return &verpSender{s: s, returnPath: returnPath}
+}
+
+type verpSender struct {
+	s          Sender
+	returnPath string
+}
+
+func (v *verpSender) Send(from string, to []string, msg io.WriterTo) error {
+	return v.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements ContextSender.
+func (v *verpSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return v.SendEnvelope(ctx, &Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements EnvelopeSender.
+func (v *verpSender) SendEnvelope(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	errs := make(RecipientErrors)
+	for _, rcpt := range env.To {
+		if err := ctx.Err(); err != nil {
+			errs[rcpt] = err
+			continue
+		}
+
+		from, err := VERPAddress(v.returnPath, rcpt)
+		if err != nil {
+			errs[rcpt] = err
+			continue
+		}
+		e := &Envelope{From: from, To: []string{rcpt}, MailParams: env.MailParams}
+		if params, ok := env.RcptParams[rcpt]; ok {
+			e.RcptParams = map[string][]string{rcpt: params}
+		}
+		if err := SendEnvelope(ctx, v.s, e, msg); err != nil {
+			errs[rcpt] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (v *verpSender) Close() error {
+	if sc, ok := v.s.(SendCloser); ok {
+		return sc.Close()
+	}
+	return nil
+}
+
+// RecipientErrors is returned when an email sent in one transaction per
+// recipient could not be sent to some of them. It maps their addresses to the
+// errors.
+type RecipientErrors map[string]error
+
+func (e RecipientErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for rcpt := range e {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+
+	msgs := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		msgs[i] = rcpt + ": " + e[rcpt].Error()
+	}
+	return fmt.Sprintf("gomail: could not send email to %d recipients: %s", len(e), strings.Join(msgs, "; "))
+}
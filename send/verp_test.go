@@ -0,0 +1,104 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestVERPAddress(t *testing.T) {
+	tests := []struct {
+		returnPath, rcpt, want string
+	}{
+		{"bounces@example.org", "user@example.com", "bounces+user=example.com@example.org"},
+		{"bounces@example.org", "user+tag@example.com", "bounces+user+tag=example.com@example.org"},
+		{"bounces@example.org", "user=x@example.com", "bounces+user=x=example.com@example.org"},
+	}
+
+	for _, test := range tests {
+		got, err := VERPAddress(test.returnPath, test.rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("VERPAddress(%q, %q) = %q, want %q", test.returnPath, test.rcpt, got, test.want)
+		}
+		rcpt, err := ParseVERP(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcpt != test.rcpt {
+			t.Errorf("ParseVERP(%q) = %q, want %q", got, rcpt, test.rcpt)
+		}
+	}
+}
+
+func TestInvalidVERP(t *testing.T) {
+	for _, test := range []struct{ returnPath, rcpt string }{
+		{"bounces", testTo1},
+		{"bounces+x@example.org", testTo1},
+		{"bounces@example.org", "user"},
+	} {
+		if _, err := VERPAddress(test.returnPath, test.rcpt); err == nil {
+			t.Errorf("VERPAddress(%q, %q) should fail", test.returnPath, test.rcpt)
+		}
+	}
+
+	for _, addr := range []string{
+		"bounces@example.org",
+		"bounces+user@example.org",
+		"bounces+=example.com@example.org",
+		"bounces+user=@example.org",
+		"bounces+user=example.com",
+	} {
+		if _, err := ParseVERP(addr); err == nil {
+			t.Errorf("ParseVERP(%q) should fail", addr)
+		}
+	}
+}
+
+func TestVERP(t *testing.T) {
+	var envs []*Envelope
+	es := &mockEnvelopeSender{}
+	s := VERP(SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		envs = append(envs, &Envelope{From: from, To: to})
+		if to[0] == testTo2 {
+			return io.EOF
+		}
+		return nil
+	}), "bounces@example.org")
+
+	err := Send(s, getTestMessage())
+	var errs RecipientErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[testTo2] != io.EOF {
+		t.Fatalf("Invalid error, got %#v", err)
+	}
+	want := []*Envelope{
+		{From: "bounces+to1=example.com@example.org", To: []string{testTo1}},
+		{From: "bounces+to2=example.com@example.org", To: []string{testTo2}},
+	}
+	if !reflect.DeepEqual(envs, want) {
+		t.Errorf("Invalid envelopes, got %+v, want %+v", envs, want)
+	}
+
+	env := &Envelope{
+		From:       testFrom,
+		To:         []string{testTo1},
+		MailParams: []string{"RET=HDRS"},
+		RcptParams: map[string][]string{testTo1: {"NOTIFY=FAILURE"}, testTo2: {"NOTIFY=NEVER"}},
+	}
+	if err := SendEnvelope(context.Background(), VERP(es, "bounces@example.org"), env, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	wantEnv := &Envelope{
+		From:       "bounces+to1=example.com@example.org",
+		To:         []string{testTo1},
+		MailParams: []string{"RET=HDRS"},
+		RcptParams: map[string][]string{testTo1: {"NOTIFY=FAILURE"}},
+	}
+	if !reflect.DeepEqual(es.env, wantEnv) {
+		t.Errorf("Invalid envelope, got %+v, want %+v", es.env, wantEnv)
+	}
+}
@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hacku7/gomail/auth"
+	"net/smtp"
+	"strings"
+)
+
+// DefaultAuthMechanisms lists the authentication mechanisms used by default,
+// from the most to the least preferred.
+var DefaultAuthMechanisms = []string{
+	"OAUTHBEARER",
+	"XOAUTH2",
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1-PLUS",
+	"SCRAM-SHA-1",
+	"CRAM-MD5",
+	"PLAIN",
+	"LOGIN",
+}
+
+// supportedAuthMechanisms lists all the mechanisms that can be set in
+// Dialer.AuthMechanisms.
+const supportedAuthMechanisms = "OAUTHBEARER XOAUTH2 SCRAM-SHA-256-PLUS SCRAM-SHA-256 " +
+	"SCRAM-SHA-1-PLUS SCRAM-SHA-1 CRAM-MD5 PLAIN LOGIN"
+
+// ErrNoAuthMechanism is returned by Dial when credentials are set but none of
+// the allowed authentication mechanisms can be used with the SMTP server.
+var ErrNoAuthMechanism = errors.New("gomail: no usable authentication mechanism")
+
+// retrier is implemented by the authentication mechanisms that can be tried
+// again after a failure, such as the OAuth 2.0 ones after a token is rejected.
+type retrier interface {
+	Retry() bool
+}
+
+// auth returns the authentication mechanism used with the connection, or nil if
+// no authentication is needed. A new smtp.Auth is returned for each connection
+// so that the Dialer is never modified.
+func (d *Dialer) auth(c smtpClient) (smtp.Auth, error) {
+	if a, ok := d.Auth.(*auth.ScramAuth); ok {
+		// A ScramAuth keeps the state of its exchange, so each connection
+		// uses its own copy, bound to the TLS connection.
+		s := &auth.ScramAuth{
+			Username:  a.Username,
+			Password:  a.Password,
+			Host:      a.Host,
+			Mechanism: a.Mechanism,
+		}
+		if cs, ok := c.TLSConnectionState(); ok {
+			s.TLSConnectionState = &cs
+		}
+		return s, nil
+	}
+	if d.Auth != nil {
+		if _, secure := c.TLSConnectionState(); d.DisablePlaintextAuth && !secure {
+			return plaintextGuard{d.Auth}, nil
+		}
+		return d.Auth, nil
+	}
+	if d.Username == "" && d.TokenSource == nil {
+		return nil, nil
+	}
+	ok, auths := c.Extension("AUTH")
+	if !ok {
+		return nil, nil
+	}
+
+	mechanisms := d.AuthMechanisms
+	if mechanisms == nil {
+		mechanisms = DefaultAuthMechanisms
+	}
+	for _, m := range mechanisms {
+		if !hasMechanism(supportedAuthMechanisms, m) {
+			return nil, fmt.Errorf("gomail: unsupported authentication mechanism %q", m)
+		}
+	}
+	for _, m := range mechanisms {
+		if !hasMechanism(auths, m) {
+			continue
+		}
+		if a := d.newAuth(m, c); a != nil {
+			return a, nil
+		}
+	}
+
+	// Some servers do not advertise the mechanisms they support, PLAIN is
+	// then tried as a last resort.
+	if len(strings.Fields(auths)) == 0 && hasMechanism(strings.Join(mechanisms, " "), "PLAIN") {
+		if a := d.newAuth("PLAIN", c); a != nil {
+			return a, nil
+		}
+	}
+	return nil, ErrNoAuthMechanism
+}
+
+// newAuth returns the given mechanism, or nil if it cannot be used with the
+// credentials of the Dialer or on the connection.
+func (d *Dialer) newAuth(mechanism string, c smtpClient) smtp.Auth {
+	cs, secure := c.TLSConnectionState()
+	password := d.Username != "" && (d.Password != "" || d.TokenSource == nil)
+
+	switch m := strings.ToUpper(mechanism); m {
+	case "OAUTHBEARER", "XOAUTH2":
+		if d.TokenSource == nil {
+			return nil
+		}
+		if m == "OAUTHBEARER" {
+			return &auth.OAuthBearerAuth{
+				Username:    d.Username,
+				TokenSource: d.TokenSource,
+				Host:        d.Host,
+				Port:        d.Port,
+			}
+		}
+		return &auth.XOAuth2Auth{
+			Username:    d.Username,
+			TokenSource: d.TokenSource,
+			Host:        d.Host,
+		}
+	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1":
+		if !password || strings.HasSuffix(m, "-PLUS") && !secure {
+			return nil
+		}
+		a := &auth.ScramAuth{
+			Username:  d.Username,
+			Password:  d.Password,
+			Host:      d.Host,
+			Mechanism: m,
+		}
+		if secure {
+			a.TLSConnectionState = &cs
+		}
+		return a
+	case "CRAM-MD5":
+		if !password {
+			return nil
+		}
+		return smtp.CRAMMD5Auth(d.Username, d.Password)
+	case "PLAIN", "LOGIN":
+		if !password || d.DisablePlaintextAuth && !secure {
+			return nil
+		}
+		if m == "PLAIN" {
+			return smtp.PlainAuth("", d.Username, d.Password, d.Host)
+		}
+		return &auth.LoginAuth{
+			Username: d.Username,
+			Password: d.Password,
+			Host:     d.Host,
+		}
+	}
+	return nil
+}
+
+// plaintextGuard prevents Dialer.Auth from using the PLAIN or LOGIN mechanism
+// on an unencrypted connection when Dialer.DisablePlaintextAuth is set.
+type plaintextGuard struct {
+	smtp.Auth
+}
+
+func (a plaintextGuard) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	mechanism, resp, err := a.Auth.Start(server)
+	if err == nil && !server.TLS && hasMechanism("PLAIN LOGIN", mechanism) {
+		return "", nil, ErrNoAuthMechanism
+	}
+	return mechanism, resp, err
+}
+
+func (a plaintextGuard) Retry() bool {
+	r, ok := a.Auth.(retrier)
+	return ok && r.Retry()
+}
+
+func hasMechanism(auths, mechanism string) bool {
+	for _, m := range strings.Fields(auths) {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
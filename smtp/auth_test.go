@@ -0,0 +1,238 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/hacku7/gomail/auth"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// acceptAuth makes the fake server accept any authentication, after a
+// challenge for CRAM-MD5.
+func acceptAuth(cmd string) string {
+	if strings.HasPrefix(cmd, "AUTH CRAM-MD5") {
+		return "334 " + base64.StdEncoding.EncodeToString([]byte("<1@localhost>"))
+	}
+	if strings.HasPrefix(cmd, "AUTH") {
+		return "235 Accepted"
+	}
+	// The response to the challenge starts with the username.
+	if b, err := base64.StdEncoding.DecodeString(cmd); err == nil && strings.HasPrefix(string(b), TestUser+" ") {
+		return "235 Accepted"
+	}
+	return ""
+}
+
+func authCommand(s *fakeServer) string {
+	for _, cmd := range s.commands() {
+		if strings.HasPrefix(cmd, "AUTH ") {
+			return cmd
+		}
+	}
+	return ""
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	tests := []struct {
+		advertised string
+		mechanisms []string
+		disable    bool
+		want       string
+	}{
+		{"PLAIN LOGIN CRAM-MD5", nil, false, "AUTH CRAM-MD5"},
+		{"LOGIN PLAIN", nil, false, "AUTH PLAIN "},
+		{"SCRAM-SHA-256 PLAIN", []string{"PLAIN", "SCRAM-SHA-256"}, false, "AUTH PLAIN "},
+		{"LOGIN CRAM-MD5", []string{"login", "cram-md5"}, false, "AUTH LOGIN"},
+		{"PLAIN LOGIN CRAM-MD5", []string{"PLAIN", "LOGIN", "CRAM-MD5"}, true, "AUTH CRAM-MD5"},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, "AUTH "+test.advertised)
+		s.reply = acceptAuth
+		d := s.dialer()
+		d.Username = TestUser
+		d.Password = TestPwd
+		d.AuthMechanisms = test.mechanisms
+		d.DisablePlaintextAuth = test.disable
+
+		sc, err := d.Dial()
+		if err != nil {
+			t.Fatalf("Dial() with %q: %v", test.advertised, err)
+		}
+		sc.Close()
+
+		if got := authCommand(s); !strings.HasPrefix(got, test.want) {
+			t.Errorf("Invalid command with %q, got %q, want %q", test.advertised, got, test.want)
+		}
+	}
+}
+
+func TestNoAuthMechanism(t *testing.T) {
+	tests := []struct {
+		advertised string
+		disable    bool
+	}{
+		{"GSSAPI", false},
+		{"PLAIN LOGIN", true},
+		{"SCRAM-SHA-256-PLUS", false},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, "AUTH "+test.advertised)
+		d := s.dialer()
+		d.Username = TestUser
+		d.Password = TestPwd
+		d.DisablePlaintextAuth = test.disable
+
+		if _, err := d.Dial(); err != ErrNoAuthMechanism {
+			t.Errorf("Invalid error with %q, got %v, want %v", test.advertised, err, ErrNoAuthMechanism)
+		}
+		if cmd := authCommand(s); cmd != "" {
+			t.Errorf("No authentication should be attempted, got %q", cmd)
+		}
+	}
+}
+
+func TestDisablePlaintextAuth(t *testing.T) {
+	tests := []struct {
+		advertised string
+		auth       smtp.Auth
+	}{
+		{"LOGIN", &auth.LoginAuth{Username: TestUser, Password: TestPwd, Host: "127.0.0.1"}},
+		{"PLAIN", smtp.PlainAuth("", TestUser, TestPwd, "127.0.0.1")},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, "AUTH "+test.advertised)
+		s.reply = acceptAuth
+		d := s.dialer()
+		d.Auth = test.auth
+		d.DisablePlaintextAuth = true
+
+		if _, err := d.Dial(); err != ErrNoAuthMechanism {
+			t.Errorf("Invalid error with %q, got %v, want %v", test.advertised, err, ErrNoAuthMechanism)
+		}
+		if cmd := authCommand(s); cmd != "" {
+			t.Errorf("The password should not be sent in clear, got %q", cmd)
+		}
+	}
+}
+
+func TestUnsupportedAuthMechanism(t *testing.T) {
+	s := newFakeServer(t, "AUTH PLAIN")
+	d := s.dialer()
+	d.Username = TestUser
+	d.Password = TestPwd
+	d.AuthMechanisms = []string{"PLAIN", "NTLM"}
+
+	if _, err := d.Dial(); err == nil || !strings.Contains(err.Error(), "NTLM") {
+		t.Errorf("Dial() should reject an unsupported mechanism, got %v", err)
+	}
+}
+
+func TestAuthDialerNotModified(t *testing.T) {
+	s := newFakeServer(t, "AUTH PLAIN")
+	s.reply = acceptAuth
+	d := s.dialer()
+	d.Username = TestUser
+	d.Password = TestPwd
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.DialAndSend(getTestMessage()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if d.Auth != nil {
+		t.Errorf("Dial() should not modify the Dialer, got Auth %#v", d.Auth)
+	}
+}
+
+// scramServer makes the fake server run SCRAM-SHA-256 exchanges with one
+// iteration, checking the proof of the client.
+func scramServer(cmd string) string {
+	const salt = "c2FsdA=="
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	serverFirst := func(nonce string) string {
+		return "r=" + nonce + "srv,s=" + salt + ",i=1"
+	}
+
+	if strings.HasPrefix(cmd, "AUTH SCRAM-SHA-256 ") {
+		b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(cmd, "AUTH SCRAM-SHA-256 "))
+		i := strings.Index(string(b), ",r=")
+		if i == -1 {
+			return "501 Invalid message"
+		}
+		return "334 " + base64.StdEncoding.EncodeToString([]byte(serverFirst(string(b[i+3:]))))
+	}
+	if cmd == "" {
+		return "235 Accepted"
+	}
+	b, err := base64.StdEncoding.DecodeString(cmd)
+	if err != nil || !strings.HasPrefix(string(b), "c=") {
+		return ""
+	}
+
+	clientFinal := string(b)
+	i := strings.Index(clientFinal, ",p=")
+	j := strings.Index(clientFinal, ",r=")
+	if i == -1 || j == -1 {
+		return "501 Invalid message"
+	}
+	nonce := strings.TrimSuffix(clientFinal[j+3:i], "srv")
+	authMessage := "n=" + TestUser + ",r=" + nonce + "," + serverFirst(nonce) + "," + clientFinal[:i]
+
+	rawSalt, _ := base64.StdEncoding.DecodeString(salt)
+	saltedPassword := hmacSHA256([]byte(TestPwd), string(rawSalt)+"\x00\x00\x00\x01")
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof, _ := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if len(proof) != len(clientKey) {
+		return "535 Invalid proof"
+	}
+	for k := range proof {
+		if proof[k]^clientSignature[k] != clientKey[k] {
+			return "535 Invalid proof"
+		}
+	}
+	serverSignature := hmacSHA256(hmacSHA256(saltedPassword, "Server Key"), authMessage)
+	return "334 " + base64.StdEncoding.EncodeToString([]byte("v="+base64.StdEncoding.EncodeToString(serverSignature)))
+}
+
+func TestAuthSharedScram(t *testing.T) {
+	s := newFakeServer(t, "AUTH SCRAM-SHA-256")
+	s.reply = scramServer
+	d := s.dialer()
+	d.Auth = &auth.ScramAuth{Username: TestUser, Password: TestPwd, Host: d.Host}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.DialAndSend(getTestMessage()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(s.messages()); n != 8 {
+		t.Errorf("Invalid number of emails, got %d, want 8", n)
+	}
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"io"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+)
+
+// client adds to smtp.Client the ability to send any command, to read the text
+// of the reply, to pipeline commands and to send the content of an email in
+// chunks.
+type client struct {
+	*smtp.Client
+}
+
+// A reply is a reply of the SMTP server.
+type reply struct {
+	code int
+	msg  string
+}
+
+// err returns the error for a reply rejecting the given command.
+func (r reply) err(command, recipient string) *Error {
+	return newError(command, recipient, &textproto.Error{Code: r.code, Msg: r.msg})
+}
+
+// Cmd sends a command and returns the code and the message of the reply. An
+// error is returned if the code does not start with expectCode, see
+// textproto.Reader.ReadResponse.
+func (c *client) Cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+// Pipeline sends the commands at once, as allowed by the PIPELINING extension
+// defined in RFC 2920, and then reads their replies. An error is only returned
+// if a reply cannot be read, the error replies are returned like the others.
+func (c *client) Pipeline(cmds ...string) ([]reply, error) {
+	for _, cmd := range cmds {
+		if _, err := c.Text.W.WriteString(cmd + "\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]reply, len(cmds))
+	for i := range cmds {
+		code, msg, err := c.Text.ReadResponse(0)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply{code: code, msg: msg}
+	}
+	return replies, nil
+}
+
+// DataWriter returns the writer of the content of an email once the DATA
+// command was accepted. Closing it ends the content and reads the reply of the
+// server.
+func (c *client) DataWriter() io.WriteCloser {
+	return &dataWriter{c: c, WriteCloser: c.Text.DotWriter()}
+}
+
+type dataWriter struct {
+	c *client
+	io.WriteCloser
+}
+
+func (w *dataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_, _, err := w.c.Text.ReadResponse(250)
+	return err
+}
+
+// chunkSize is the maximum size of the chunks sent with BDAT. Stubbed out for
+// testing.
+var chunkSize = 1 << 20
+
+// ChunkWriter returns the writer of the content of an email sent with BDAT
+// commands, as allowed by the CHUNKING extension defined in RFC 3030. Unlike
+// with DATA, the content is not dot-stuffed. Closing it sends the last chunk.
+func (c *client) ChunkWriter() io.WriteCloser {
+	return &chunkWriter{c: c, buf: make([]byte, 0, chunkSize)}
+}
+
+type chunkWriter struct {
+	c   *client
+	buf []byte
+	err error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.flush(false)
+		}
+	}
+	return n, w.err
+}
+
+func (w *chunkWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	return w.err
+}
+
+// flush sends the buffered content with a BDAT command and reads its reply.
+func (w *chunkWriter) flush(last bool) error {
+	cmd := "BDAT " + strconv.Itoa(len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	if _, err := w.c.Text.W.WriteString(cmd + "\r\n"); err != nil {
+		return err
+	}
+	if _, err := w.c.Text.W.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.c.Text.W.Flush(); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	_, _, err := w.c.Text.ReadResponse(250)
+	return err
+}
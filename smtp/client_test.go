@@ -0,0 +1,254 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/hacku7/gomail/msg"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipelining(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING")
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	res, err := sc.(ResultSender).SendResult(context.Background(), testFrom, []string{testTo1, testBadTo, testTo2}, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Result{
+		Accepted: []RecipientResult{
+			{Address: testTo1, Code: 250, Message: "OK"},
+			{Address: testTo2, Code: 250, Message: "OK"},
+		},
+		Rejected: []RecipientResult{
+			{Address: testBadTo, Code: 550, EnhancedCode: "5.1.1", Message: "No such user"},
+		},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Invalid result, got %+v, want %+v", res, want)
+	}
+	if !hasCommand(s, "DATA") {
+		t.Error("The email should be sent to the accepted recipients")
+	}
+
+	if err := sc.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Error(err)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+}
+
+func TestPipeliningRecipientRejected(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING")
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testBadTo, testTo1}, getTestMessage())
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Command != "RCPT" || serr.Recipient != testBadTo {
+		t.Fatalf("Invalid error, got %#v, want an *Error for %s", err, testBadTo)
+	}
+	// The commands are sent before the replies are read.
+	if !hasCommand(s, "RCPT TO:<"+testTo1+">") {
+		t.Errorf("The commands should be pipelined, got %q", s.commands())
+	}
+
+	// DATA was accepted so the connection had to be closed.
+	if err := sc.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Error(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("Invalid number of connections, got %d, want 2", n)
+	}
+}
+
+func TestPipeliningAllRecipientsRejected(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING")
+	s.reply = func(cmd string) string {
+		if cmd == "DATA" {
+			return "554 5.5.1 No valid recipients"
+		}
+		return rejectBadRecipient(cmd)
+	}
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testBadTo}, getTestMessage())
+	if _, ok := err.(*RejectedRecipientsError); !ok {
+		t.Fatalf("Invalid error, got %#v, want a *RejectedRecipientsError", err)
+	}
+	if !hasCommand(s, "RSET") {
+		t.Error("The transaction should be reset")
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+}
+
+func TestPipeliningMailRejected(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING")
+	s.reply = func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "MAIL"):
+			return "451 4.3.0 Try again later"
+		case strings.HasPrefix(cmd, "RCPT"), cmd == "DATA":
+			return "503 5.5.1 Bad sequence of commands"
+		}
+		return ""
+	}
+	d := s.dialer()
+
+	err := d.DialAndSend(getTestMessage())
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Command != "MAIL" || !serr.IsTemporary() {
+		t.Errorf("Invalid error, got %#v, want a temporary *Error for MAIL", err)
+	}
+}
+
+func TestPipeliningMailParameters(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING", "8BITMIME", "SMTPUTF8")
+	d := s.dialer()
+
+	if err := d.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "MAIL FROM:<" + testFrom + "> BODY=8BITMIME SMTPUTF8"; !hasCommand(s, want) {
+		t.Errorf("Invalid commands, got %q, want %q", s.commands(), want)
+	}
+}
+
+// stubChunkSize sets the size of the BDAT chunks for the duration of the test.
+func stubChunkSize(t *testing.T, size int) {
+	old := chunkSize
+	chunkSize = size
+	t.Cleanup(func() { chunkSize = old })
+}
+
+func TestChunking(t *testing.T) {
+	for _, ext := range [][]string{{"CHUNKING"}, {"CHUNKING", "PIPELINING"}} {
+		s := newFakeServer(t, ext...)
+		stubChunkSize(t, 100)
+		d := s.dialer()
+
+		m := getTestMessage()
+		m.SetBody("text/plain", ".dot\r\n"+strings.Repeat("a", 150))
+		if err := d.DialAndSend(m); err != nil {
+			t.Fatal(err)
+		}
+
+		var want bytes.Buffer
+		if _, err := m.WriteTo(&want); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.messages(); len(got) != 1 || got[0] != want.String() {
+			t.Errorf("Invalid email with %v, got %q, want %q", ext, got, want.String())
+		}
+		if hasCommand(s, "DATA") {
+			t.Errorf("DATA should not be sent with %v", ext)
+		}
+		if !hasCommand(s, "BDAT 100") {
+			t.Errorf("The email should be sent in chunks with %v, got %q", ext, s.commands())
+		}
+	}
+}
+
+func TestChunkRejected(t *testing.T) {
+	s := newFakeServer(t, "CHUNKING")
+	s.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "BDAT") {
+			return "552 5.3.4 Message too big"
+		}
+		return ""
+	}
+	d := s.dialer()
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testTo1}, getTestMessage())
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Command != "BDAT" || serr.Code != 552 {
+		t.Fatalf("Invalid error, got %#v, want an *Error for BDAT", err)
+	}
+	if !hasCommand(s, "RSET") {
+		t.Error("The transaction should be reset")
+	}
+
+	s.reply = nil
+	if err := sc.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Error(err)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+}
+
+func TestBinaryMIME(t *testing.T) {
+	const content = "\x00\xff\r\n.\r\n"
+	m := getTestMessage()
+	m.Attach("test.bin", msg.SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	}))
+
+	tests := []struct {
+		ext        []string
+		binaryMIME bool
+		mail       string
+		binary     bool
+	}{
+		{[]string{"CHUNKING", "BINARYMIME", "8BITMIME"}, true, " BODY=BINARYMIME", true},
+		{[]string{"CHUNKING", "BINARYMIME", "8BITMIME"}, false, " BODY=8BITMIME", false},
+		{[]string{"BINARYMIME", "8BITMIME"}, true, " BODY=8BITMIME", false},
+		{[]string{"CHUNKING", "8BITMIME"}, true, " BODY=8BITMIME", false},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, test.ext...)
+		d := s.dialer()
+		d.BinaryMIME = test.binaryMIME
+
+		if err := d.DialAndSend(m); err != nil {
+			t.Fatal(err)
+		}
+		if mail := "MAIL FROM:<" + testFrom + ">" + test.mail; !hasCommand(s, mail) {
+			t.Errorf("Invalid commands with %v, got %q, want %q", test.ext, s.commands(), mail)
+		}
+		got := s.messages()
+		if len(got) != 1 {
+			t.Fatalf("Invalid number of emails, got %d", len(got))
+		}
+		if binary := strings.Contains(got[0], "\r\n\r\n"+content); binary != test.binary {
+			t.Errorf("Invalid encoding with %v and BinaryMIME %v, got %q", test.ext, test.binaryMIME, got[0])
+		}
+	}
+}
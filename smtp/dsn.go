@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// A DSN contains the Delivery Status Notification options of an email, as
+// defined in RFC 3461. They are only sent if the SMTP server supports the DSN
+// extension.
+type DSN struct {
+	// Return defines whether the full email or only its headers are returned
+	// in a failure notification. By default, the server decides.
+	Return DSNReturn
+	// EnvelopeID is an identifier of the email returned in the
+	// notifications, for example the ID of the email in a database.
+	EnvelopeID string
+	// Notify defines when the recipients generate a notification. By default,
+	// the server decides, usually on failure only.
+	Notify Notify
+	// Recipients contains the options of specific recipients, by address.
+	Recipients map[string]RecipientDSN
+}
+
+// A RecipientDSN contains the Delivery Status Notification options of a
+// recipient.
+type RecipientDSN struct {
+	// Notify overrides DSN.Notify for the recipient.
+	Notify Notify
+	// OriginalRecipient is the original address of the recipient, sent with
+	// the ORCPT parameter, for example when the email is sent to an alias.
+	OriginalRecipient string
+}
+
+// DSNReturn defines what is returned in a failure notification.
+type DSNReturn string
+
+const (
+	// DSNReturnFull returns the full email.
+	DSNReturnFull DSNReturn = "FULL"
+	// DSNReturnHeaders only returns the headers of the email.
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// Notify defines when a notification is generated for a recipient. The values
+// can be combined, except NotifyNever.
+type Notify uint8
+
+const (
+	// NotifyNever never generates a notification.
+	NotifyNever Notify = 1 << iota
+	// NotifySuccess generates a notification when the email is delivered.
+	NotifySuccess
+	// NotifyFailure generates a notification when the email cannot be
+	// delivered.
+	NotifyFailure
+	// NotifyDelay generates a notification when the delivery is delayed.
+	NotifyDelay
+)
+
+// String returns the value of the NOTIFY parameter, for example
+// "SUCCESS,FAILURE".
+func (n Notify) String() string {
+	var values []string
+	for _, v := range []struct {
+		n    Notify
+		name string
+	}{
+		{NotifyNever, "NEVER"},
+		{NotifySuccess, "SUCCESS"},
+		{NotifyFailure, "FAILURE"},
+		{NotifyDelay, "DELAY"},
+	} {
+		if n&v.n != 0 {
+			values = append(values, v.name)
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+type dsnKey struct{}
+
+// WithDSN returns a copy of ctx which makes the emails sent with it use the
+// given DSN options instead of the ones of the Dialer. It can be used with
+// the SendContext methods of the SendCloser returned by Dialer and of Pool.
+func WithDSN(ctx context.Context, dsn *DSN) context.Context {
+	return context.WithValue(ctx, dsnKey{}, dsn)
+}
+
+// dsn returns the DSN options of the emails sent with ctx.
+func (d *Dialer) dsn(ctx context.Context) *DSN {
+	if dsn, ok := ctx.Value(dsnKey{}).(*DSN); ok {
+		return dsn
+	}
+	return d.DSN
+}
+
+func (d *DSN) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Return != "" && d.Return != DSNReturnFull && d.Return != DSNReturnHeaders {
+		return fmt.Errorf("gomail: invalid DSN return %q", d.Return)
+	}
+	if err := d.Notify.validate(); err != nil {
+		return err
+	}
+	for _, r := range d.Recipients {
+		if err := r.Notify.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n Notify) validate() error {
+	if n&NotifyNever != 0 && n != NotifyNever {
+		return fmt.Errorf("gomail: NEVER cannot be combined with other DSN notifications, got %s", n)
+	}
+	return nil
+}
+
+// mailParams returns the DSN parameters of the MAIL command.
+func (d *DSN) mailParams() string {
+	if d == nil {
+		return ""
+	}
+	var params string
+	if d.Return != "" {
+		params += " RET=" + string(d.Return)
+	}
+	if d.EnvelopeID != "" {
+		params += " ENVID=" + xtext(d.EnvelopeID)
+	}
+	return params
+}
+
+// rcptParams returns the DSN parameters of the RCPT command of addr.
+func (d *DSN) rcptParams(addr string) string {
+	if d == nil {
+		return ""
+	}
+	r := d.Recipients[addr]
+	notify := r.Notify
+	if notify == 0 {
+		notify = d.Notify
+	}
+
+	var params string
+	if notify != 0 {
+		params += " NOTIFY=" + notify.String()
+	}
+	if r.OriginalRecipient != "" {
+		params += " ORCPT=rfc822;" + xtext(r.OriginalRecipient)
+	}
+	return params
+}
+
+// xtext encodes s as defined in RFC 3461, section 4: the characters that are
+// not printable ASCII, "+" and "=" are replaced by "+" and their hexadecimal
+// value.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"context"
+	"github.com/hacku7/gomail/send"
+	"testing"
+)
+
+func TestDSN(t *testing.T) {
+	for _, ext := range [][]string{{"DSN"}, {"DSN", "PIPELINING"}} {
+		s := newFakeServer(t, ext...)
+		d := s.dialer()
+		d.DSN = &DSN{
+			Return:     DSNReturnHeaders,
+			EnvelopeID: "id+1=2",
+			Notify:     NotifyFailure | NotifyDelay,
+			Recipients: map[string]RecipientDSN{
+				testTo2: {Notify: NotifySuccess, OriginalRecipient: "alias@example.com"},
+			},
+		}
+
+		if err := d.DialAndSend(getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range []string{
+			"MAIL FROM:<" + testFrom + "> RET=HDRS ENVID=id+2B1+3D2",
+			"RCPT TO:<" + testTo1 + "> NOTIFY=FAILURE,DELAY",
+			"RCPT TO:<" + testTo2 + "> NOTIFY=SUCCESS ORCPT=rfc822;alias@example.com",
+		} {
+			if !hasCommand(s, cmd) {
+				t.Errorf("Invalid commands with %v, got %q, want %q", ext, s.commands(), cmd)
+			}
+		}
+	}
+}
+
+func TestDSNNotSupported(t *testing.T) {
+	s := newFakeServer(t)
+	d := s.dialer()
+	d.DSN = &DSN{Return: DSNReturnFull, Notify: NotifyNever}
+
+	if err := d.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+	} {
+		if !hasCommand(s, cmd) {
+			t.Errorf("The DSN options should not be sent, got %q, want %q", s.commands(), cmd)
+		}
+	}
+}
+
+func TestWithDSN(t *testing.T) {
+	s := newFakeServer(t, "DSN")
+	d := s.dialer()
+	d.DSN = &DSN{Return: DSNReturnFull}
+
+	ctx := WithDSN(context.Background(), &DSN{Notify: NotifyNever})
+	if err := d.DialAndSendContext(ctx, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + "> NOTIFY=NEVER",
+	} {
+		if !hasCommand(s, cmd) {
+			t.Errorf("Invalid commands, got %q, want %q", s.commands(), cmd)
+		}
+	}
+}
+
+func TestInvalidDSN(t *testing.T) {
+	tests := []*DSN{
+		{Return: "BODY"},
+		{Notify: NotifyNever | NotifyFailure},
+		{Recipients: map[string]RecipientDSN{testTo1: {Notify: NotifyNever | NotifySuccess}}},
+	}
+
+	for _, dsn := range tests {
+		s := newFakeServer(t, "DSN")
+		d := s.dialer()
+
+		sc, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = send.SendContext(WithDSN(context.Background(), dsn), sc, getTestMessage())
+		sc.Close()
+		if err == nil {
+			t.Errorf("Expected an error for %+v", dsn)
+		}
+		if hasCommand(s, "MAIL FROM:<"+testFrom+">") {
+			t.Errorf("The email should not be sent with %+v", dsn)
+		}
+	}
+}
+
+func TestXText(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"a+b=c", "a+2Bb+3Dc"},
+		{"a b\r\n", "a+20b+0D+0A"},
+		{"é", "+C3+A9"},
+	}
+
+	for _, test := range tests {
+		if got := xtext(test.s); got != test.want {
+			t.Errorf("xtext(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// An Error is an error reply of the SMTP server. The errors returned by the
+// SendCloser of a Dialer and by Pool wrap an *Error when the server rejected
+// a command, so it can be retrieved with errors.As even through send.Send.
+type Error struct {
+	// Code is the SMTP reply code, for example 550.
+	Code int
+	// EnhancedCode is the enhanced status code defined in RFC 3463, for
+	// example "5.1.1", or "" if the server did not send one.
+	EnhancedCode string
+	// Message is the text of the reply, without the enhanced status code.
+	Message string
+	// Command is the SMTP command that failed, for example "MAIL", "RCPT" or
+	// "DATA", or "CONNECT" if the server rejected the connection in its
+	// greeting.
+	Command string
+	// Recipient is the recipient rejected by the RCPT command.
+	Recipient string
+
+	err *textproto.Error
+}
+
+// enhancedCodeRegExp matches the enhanced status code at the beginning of a
+// line of a reply.
+var enhancedCodeRegExp = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?: |$)`)
+
+func newError(command, recipient string, err *textproto.Error) *Error {
+	code, msg := splitEnhancedCode(err.Msg)
+	return &Error{
+		Code:         err.Code,
+		EnhancedCode: code,
+		Message:      msg,
+		Command:      command,
+		Recipient:    recipient,
+		err:          err,
+	}
+}
+
+// splitEnhancedCode separates the enhanced status code from the text of a
+// reply.
+func splitEnhancedCode(msg string) (code, text string) {
+	lines := strings.Split(msg, "\n")
+	m := enhancedCodeRegExp.FindStringSubmatch(lines[0])
+	if m == nil {
+		return "", msg
+	}
+	// The code is usually repeated on each line of the reply.
+	for i, l := range lines {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(l, m[1]), " ")
+	}
+	return m[1], strings.Join(lines, "\n")
+}
+
+// wrapError returns an *Error if err is an error reply of the server to the
+// given command. Otherwise err is returned unchanged.
+func wrapError(command, recipient string, err error) error {
+	if terr, ok := err.(*textproto.Error); ok {
+		return newError(command, recipient, terr)
+	}
+	return err
+}
+
+func (e *Error) Error() string {
+	cmd := e.Command
+	if e.Recipient != "" {
+		cmd += " " + e.Recipient
+	}
+	reply := fmt.Sprintf("%03d", e.Code)
+	if e.EnhancedCode != "" {
+		reply += " " + e.EnhancedCode
+	}
+	return fmt.Sprintf("gomail: %s failed: %s %s", cmd, reply, e.Message)
+}
+
+// Unwrap returns the underlying *textproto.Error.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// IsTemporary reports whether the failure is temporary, in which case the
+// command may succeed later. The class of the enhanced status code is used if
+// available since it is more reliable than the reply code.
+func (e *Error) IsTemporary() bool {
+	return e.class() == 4
+}
+
+// IsPermanent reports whether the failure is permanent, in which case the
+// command should not be retried as is.
+func (e *Error) IsPermanent() bool {
+	return e.class() == 5
+}
+
+func (e *Error) class() int {
+	if e.EnhancedCode != "" {
+		return int(e.EnhancedCode[0] - '0')
+	}
+	return e.Code / 100
+}
+
+// A SizeError is returned when an email exceeds the maximum size accepted by
+// the SMTP server, as advertised with the SIZE extension. The email is not
+// sent and the connection can still be used.
+type SizeError struct {
+	// Size is the size of the email in bytes.
+	Size int64
+	// Limit is the maximum size accepted by the server in bytes.
+	Limit int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("gomail: the email is too large, %d bytes exceed the limit of %d bytes", e.Size, e.Limit)
+}
@@ -0,0 +1,226 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		code         int
+		msg          string
+		enhancedCode string
+		text         string
+		temporary    bool
+		permanent    bool
+	}{
+		{550, "5.1.1 No such user", "5.1.1", "No such user", false, true},
+		{451, "4.3.0 Try again later", "4.3.0", "Try again later", true, false},
+		{554, "5.7.1 Rejected\n5.7.1 See the policy", "5.7.1", "Rejected\nSee the policy", false, true},
+		{421, "Service not available", "", "Service not available", true, false},
+		{550, "5.1.10", "5.1.10", "", false, true},
+		{450, "5.1.1.1 Not a code", "", "5.1.1.1 Not a code", true, false},
+	}
+
+	for _, test := range tests {
+		e := newError("RCPT", testTo1, &textproto.Error{Code: test.code, Msg: test.msg})
+		if e.EnhancedCode != test.enhancedCode {
+			t.Errorf("Invalid enhanced code for %q, got %q, want %q", test.msg, e.EnhancedCode, test.enhancedCode)
+		}
+		if e.Message != test.text {
+			t.Errorf("Invalid message for %q, got %q, want %q", test.msg, e.Message, test.text)
+		}
+		if e.IsTemporary() != test.temporary {
+			t.Errorf("Invalid IsTemporary() for %d %q, got %v", test.code, test.msg, e.IsTemporary())
+		}
+		if e.IsPermanent() != test.permanent {
+			t.Errorf("Invalid IsPermanent() for %d %q, got %v", test.code, test.msg, e.IsPermanent())
+		}
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	e := newError("RCPT", testTo1, &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	want := "gomail: RCPT " + testTo1 + " failed: 550 5.1.1 No such user"
+	if got := e.Error(); got != want {
+		t.Errorf("Invalid error, got %q, want %q", got, want)
+	}
+
+	var terr *textproto.Error
+	if !errors.As(e, &terr) || terr.Code != 550 {
+		t.Errorf("The *textproto.Error should be unwrapped, got %v", terr)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	tests := []struct {
+		cmd       string
+		reply     string
+		command   string
+		recipient string
+		temporary bool
+	}{
+		{"MAIL", "451 4.3.0 Try again later", "MAIL", "", true},
+		{"RCPT TO:<" + testTo2 + ">", "550 5.1.1 No such user", "RCPT", testTo2, false},
+		{"DATA", "554 No valid recipients", "DATA", "", false},
+		{".", "552 5.3.4 Message too big", "DATA", "", false},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t)
+		s.reply = func(cmd string) string {
+			if strings.HasPrefix(cmd, test.cmd) {
+				return test.reply
+			}
+			return ""
+		}
+		d := s.dialer()
+
+		sc, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = send.Send(sc, getTestMessage())
+		sc.Close()
+
+		var serr *Error
+		if !errors.As(err, &serr) {
+			t.Errorf("Invalid error for %q, got %#v, want an *Error", test.cmd, err)
+			continue
+		}
+		if serr.Command != test.command || serr.Recipient != test.recipient {
+			t.Errorf("Invalid command for %q, got %q %q, want %q %q", test.cmd, serr.Command, serr.Recipient, test.command, test.recipient)
+		}
+		if serr.IsTemporary() != test.temporary {
+			t.Errorf("Invalid IsTemporary() for %q, got %v", test.cmd, serr.IsTemporary())
+		}
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	s := newFakeServer(t, "AUTH PLAIN")
+	s.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "AUTH") {
+			return "535 5.7.8 Authentication credentials invalid"
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.Username = TestUser
+	d.Password = TestPwd
+
+	_, err := d.Dial()
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Command != "AUTH" || serr.EnhancedCode != "5.7.8" {
+		t.Errorf("Invalid error, got %#v", err)
+	}
+}
+
+func TestGreetingError(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectGreeting
+	d := s.dialer()
+
+	_, err := d.Dial()
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Command != "CONNECT" || serr.Code != 421 || serr.EnhancedCode != "4.3.2" {
+		t.Errorf("Invalid error, got %#v", err)
+	}
+	if !send.IsTemporary(err) {
+		t.Errorf("A 421 greeting should be temporary, got %v", err)
+	}
+}
+
+func TestSizeError(t *testing.T) {
+	s := newFakeServer(t, "SIZE 1000")
+	d := s.dialer()
+	d.CheckSize = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	m := getTestMessage()
+	m.SetBody("text/plain", strings.Repeat("a", 1000))
+	err = send.Send(sc, m)
+	var serr *SizeError
+	if !errors.As(err, &serr) || serr.Limit != 1000 || serr.Size <= 1000 {
+		t.Fatalf("Invalid error, got %#v, want a *SizeError", err)
+	}
+	if send.IsTemporary(err) {
+		t.Error("A *SizeError should not be temporary")
+	}
+	if hasCommand(s, "MAIL FROM:<"+testFrom+">") {
+		t.Errorf("The email should not be sent, got %q", s.commands())
+	}
+
+	// The connection is still usable.
+	m = getTestMessage()
+	if err := send.Send(sc, m); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if mail := fmt.Sprintf("MAIL FROM:<%s> SIZE=%d", testFrom, buf.Len()); !hasCommand(s, mail) {
+		t.Errorf("Invalid commands, got %q, want %q", s.commands(), mail)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+}
+
+func TestSizeWithoutLimit(t *testing.T) {
+	s := newFakeServer(t, "SIZE")
+	d := s.dialer()
+	d.CheckSize = true
+
+	m := getTestMessage()
+	m.SetBody("text/plain", strings.Repeat("a", 10000))
+	if err := d.DialAndSend(m); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCommand(s, "DATA") {
+		t.Error("The email should be sent")
+	}
+}
+
+// writeOnce is an email that can only be written once.
+type writeOnce struct {
+	written bool
+}
+
+func (m *writeOnce) WriteTo(w io.Writer) (int64, error) {
+	if m.written {
+		return 0, errors.New("the email was already written")
+	}
+	m.written = true
+	n, err := io.WriteString(w, "Subject: Test\r\n\r\nTest\r\n")
+	return int64(n), err
+}
+
+func TestSizeNotChecked(t *testing.T) {
+	s := newFakeServer(t, "SIZE 1000")
+	d := s.dialer()
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if err := sc.Send(testFrom, []string{testTo1}, &writeOnce{}); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCommand(s, "MAIL FROM:<"+testFrom+">") {
+		t.Errorf("The SIZE parameter should not be sent, got %q", s.commands())
+	}
+}
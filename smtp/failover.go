@@ -0,0 +1,266 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hacku7/gomail/msg"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultCooldown is the default time during which a server is not used after
+// a failure.
+const DefaultCooldown = time.Minute
+
+// A FailoverDialer is a dialer to several SMTP servers. When a server cannot
+// be reached, closes the connection or replies with a temporary error, the
+// email is sent with the next server and the failing server is marked
+// unhealthy for a cool-down period, during which it is only used if all the
+// other servers fail too. An email whose recipients are split into several
+// transactions, see Dialer.MaxRecipients, is not sent with the next server
+// once it was sent to some of them, since they would receive it twice.
+type FailoverDialer struct {
+	// Dialers contains the Dialers of the servers, from the most to the least
+	// preferred. It must not be modified once the FailoverDialer is used.
+	Dialers []*Dialer
+	// RoundRobin spreads the connections across the healthy servers instead
+	// of always using the most preferred one.
+	RoundRobin bool
+	// Cooldown is the time during which a server is unhealthy after a
+	// failure. By default, DefaultCooldown.
+	Cooldown time.Duration
+
+	mu      sync.Mutex
+	servers []serverState
+	next    int
+}
+
+type serverState struct {
+	failures  int
+	lastError error
+	retryAt   time.Time
+}
+
+// A ServerStatus is the state of a server of a FailoverDialer.
+type ServerStatus struct {
+	Host string
+	Port int
+	// Healthy is false during the cool-down period following a failure.
+	Healthy bool
+	// Failures is the number of consecutive failures of the server.
+	Failures int
+	// LastError is the error of the last failure, or nil if the server did
+	// not fail since it was last used successfully.
+	LastError error
+	// RetryAt is the end of the cool-down period of the last failure.
+	RetryAt time.Time
+}
+
+// NewFailoverDialer returns a new FailoverDialer using the given Dialers, from
+// the most to the least preferred.
+func NewFailoverDialer(dialers ...*Dialer) *FailoverDialer {
+	return &FailoverDialer{Dialers: dialers}
+}
+
+// Status returns the state of each server, in the order of Dialers.
+func (f *FailoverDialer) Status() []ServerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	now := timeNow()
+	status := make([]ServerStatus, len(f.Dialers))
+	for i, d := range f.Dialers {
+		s := f.servers[i]
+		status[i] = ServerStatus{
+			Host:      d.Host,
+			Port:      d.Port,
+			Healthy:   !now.Before(s.retryAt),
+			Failures:  s.failures,
+			LastError: s.lastError,
+			RetryAt:   s.retryAt,
+		}
+	}
+	return status
+}
+
+// Dial dials one of the servers and authenticates to it. The returned
+// SendCloser fails over to the other servers when needed.
+func (f *FailoverDialer) Dial() (send.SendCloser, error) {
+	return f.DialContext(context.Background())
+}
+
+// DialContext is like Dial but ctx bounds the connection to the servers.
+func (f *FailoverDialer) DialContext(ctx context.Context) (send.SendCloser, error) {
+	s, i, err := f.dial(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &failoverSender{f: f, s: s, i: i, tried: map[int]bool{i: true}}, nil
+}
+
+// DialAndSend opens a connection to one of the servers, sends the given
+// emails and closes the connection.
+func (f *FailoverDialer) DialAndSend(m ...*msg.Message) error {
+	return f.DialAndSendContext(context.Background(), m...)
+}
+
+// DialAndSendContext is like DialAndSend but ctx bounds the connection and
+// the sending of the emails.
+func (f *FailoverDialer) DialAndSendContext(ctx context.Context, m ...*msg.Message) error {
+	s, err := f.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return send.SendContext(ctx, s, m...)
+}
+
+// dial connects to the first server that is not in skip and accepts the
+// connection.
+func (f *FailoverDialer) dial(ctx context.Context, skip map[int]bool) (*smtpSender, int, error) {
+	if len(f.Dialers) == 0 {
+		return nil, 0, fmt.Errorf("gomail: no SMTP server to dial")
+	}
+
+	var err error
+	for _, i := range f.order() {
+		if skip[i] {
+			continue
+		}
+		var s *smtpSender
+		if s, err = f.Dialers[i].dial(ctx); err == nil {
+			return s, i, nil
+		}
+		if ctx.Err() != nil || deadlineReached(ctx) {
+			// The server did not fail, the connection was cancelled.
+			break
+		}
+		f.fail(i, err)
+	}
+	if err == nil {
+		return nil, 0, fmt.Errorf("gomail: no other SMTP server to dial")
+	}
+	return nil, 0, err
+}
+
+// order returns the indexes of the servers in the order they should be tried:
+// the healthy ones first.
+func (f *FailoverDialer) order() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	n := len(f.Dialers)
+	start := 0
+	if f.RoundRobin {
+		start = f.next % n
+		f.next++
+	}
+
+	now := timeNow()
+	var healthy, unhealthy []int
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		if now.Before(f.servers[i].retryAt) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (f *FailoverDialer) init() {
+	if f.servers == nil {
+		f.servers = make([]serverState, len(f.Dialers))
+	}
+}
+
+// fail marks a server unhealthy.
+func (f *FailoverDialer) fail(i int, err error) {
+	cooldown := f.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &f.servers[i]
+	s.failures++
+	s.lastError = err
+	s.retryAt = timeNow().Add(cooldown)
+}
+
+// succeed marks a server healthy.
+func (f *FailoverDialer) succeed(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.servers[i] = serverState{}
+}
+
+// failoverSender sends emails with a server of a FailoverDialer and switches to
+// another server when it fails.
+type failoverSender struct {
+	f *FailoverDialer
+	s *smtpSender
+	i int
+	// tried contains the servers that failed while sending the current email.
+	tried map[int]bool
+}
+
+func (c *failoverSender) Send(from string, to []string, msg io.WriterTo) error {
+	return c.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements send.ContextSender.
+func (c *failoverSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return resultError(c.SendResult(ctx, from, to, msg))
+}
+
+// SendResult implements ResultSender.
+func (c *failoverSender) SendResult(ctx context.Context, from string, to []string, msg io.WriterTo) (*Result, error) {
+	return c.SendEnvelopeResult(ctx, &send.Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements send.EnvelopeSender.
+func (c *failoverSender) SendEnvelope(ctx context.Context, env *send.Envelope, msg io.WriterTo) error {
+	return resultError(c.SendEnvelopeResult(ctx, env, msg))
+}
+
+// SendEnvelopeResult implements ResultSender.
+func (c *failoverSender) SendEnvelopeResult(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, error) {
+	c.tried = map[int]bool{c.i: true}
+	for {
+		res, sent, err := c.s.sendEnvelope(ctx, env, msg)
+		if err == nil || ctx.Err() != nil || !canTryNextHost(err) {
+			if err == nil {
+				c.f.succeed(c.i)
+			}
+			return res, err
+		}
+		if sent {
+			c.f.fail(c.i, err)
+			return res, err
+		}
+
+		c.f.fail(c.i, err)
+		s, i, derr := c.f.dial(ctx, c.tried)
+		if derr != nil {
+			return res, err
+		}
+		c.s.Close()
+		c.s, c.i = s, i
+		c.tried[i] = true
+	}
+}
+
+func (c *failoverSender) Close() error {
+	return c.s.Close()
+}
+
+// Stubbed out for testing.
+var timeNow = time.Now
@@ -0,0 +1,257 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rejectGreeting(cmd string) string {
+	if cmd == greeting {
+		return "421 4.3.2 Service not available"
+	}
+	return ""
+}
+
+func TestFailoverDialer(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply = rejectGreeting
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	if err := f.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s2.messages()); n != 1 {
+		t.Errorf("The email should be sent to the second server, got %d emails", n)
+	}
+
+	status := f.Status()
+	if s := status[0]; s.Healthy || s.Failures != 1 || s.LastError == nil || s.RetryAt.IsZero() {
+		t.Errorf("The first server should be unhealthy, got %+v", s)
+	}
+	if s := status[1]; !s.Healthy || s.Failures != 0 || s.LastError != nil {
+		t.Errorf("The second server should be healthy, got %+v", s)
+	}
+}
+
+func TestFailoverDialerTemporaryError(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			return "451 4.3.0 Try again later"
+		}
+		return ""
+	}
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	s, err := f.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s2.messages()); n != 1 {
+		t.Errorf("The email should be sent to the second server, got %d emails", n)
+	}
+	if s := f.Status()[0]; s.Healthy {
+		t.Errorf("The first server should be unhealthy, got %+v", s)
+	}
+}
+
+func TestFailoverDialerPermanentError(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			return "550 5.7.1 Sender rejected"
+		}
+		return ""
+	}
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	var serr *Error
+	if err := f.DialAndSend(getTestMessage()); !errors.As(err, &serr) || serr.Code != 550 {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n := s2.connections(); n != 0 {
+		t.Errorf("A permanent error should not fail over, got %d connections", n)
+	}
+	if s := f.Status()[0]; !s.Healthy {
+		t.Errorf("A permanent error should not mark the server unhealthy, got %+v", s)
+	}
+}
+
+func TestFailoverDialerAllFailing(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply, s2.reply = rejectGreeting, rejectGreeting
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	var terr *textproto.Error
+	if err := f.DialAndSend(getTestMessage()); !errors.As(err, &terr) || terr.Code != 421 {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if s1.connections() != 1 || s2.connections() != 1 {
+		t.Errorf("Each server should be tried once, got %d and %d connections", s1.connections(), s2.connections())
+	}
+
+	// Unhealthy servers are still tried when no server is healthy.
+	f.DialAndSend(getTestMessage())
+	if s1.connections() != 2 || s2.connections() != 2 {
+		t.Errorf("Unhealthy servers should be tried, got %d and %d connections", s1.connections(), s2.connections())
+	}
+	if s := f.Status()[0]; s.Failures != 2 {
+		t.Errorf("Invalid number of failures, got %d, want 2", s.Failures)
+	}
+}
+
+func TestFailoverDialerRoundRobin(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+	f.RoundRobin = true
+
+	for i := 0; i < 4; i++ {
+		if err := f.DialAndSend(getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s1.messages()) != 2 || len(s2.messages()) != 2 {
+		t.Errorf("The emails should be spread across the servers, got %d and %d emails", len(s1.messages()), len(s2.messages()))
+	}
+}
+
+func TestFailoverDialerCooldown(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply = rejectGreeting
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+	f.Cooldown = time.Minute
+
+	for i := 0; i < 2; i++ {
+		if err := f.DialAndSend(getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s1.connections(); n != 1 {
+		t.Errorf("An unhealthy server should not be tried, got %d connections", n)
+	}
+
+	now = now.Add(time.Minute)
+	if !f.Status()[0].Healthy {
+		t.Error("The server should be healthy after the cool-down period")
+	}
+	if err := f.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s1.connections(); n != 2 {
+		t.Errorf("The server should be tried after the cool-down period, got %d connections", n)
+	}
+}
+
+func TestFailoverDialerLocalError(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	m := getTestMessage()
+	m.Attach("/does/not/exist.pdf")
+	if err := f.DialAndSend(m); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n := s2.connections(); n != 0 {
+		t.Errorf("A local error should not fail over, got %d connections", n)
+	}
+	if s := f.Status()[0]; !s.Healthy || s.Failures != 0 {
+		t.Errorf("A local error should not mark the server unhealthy, got %+v", s)
+	}
+}
+
+func TestFailoverDialerContextCanceled(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	s1.reply = func(cmd string) string {
+		if cmd == greeting {
+			return hang
+		}
+		return ""
+	}
+	f := NewFailoverDialer(s1.dialer(), s2.dialer())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.DialContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n := s2.connections(); n != 0 {
+		t.Errorf("A cancelled connection should not fail over, got %d connections", n)
+	}
+	if s := f.Status()[0]; !s.Healthy || s.Failures != 0 {
+		t.Errorf("A cancelled connection should not mark the server unhealthy, got %+v", s)
+	}
+}
+
+func TestFailoverDialerMaxRecipients(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	mails := 0
+	s1.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			if mails++; mails > 1 {
+				return "451 4.3.0 Try again later"
+			}
+		}
+		return ""
+	}
+	d1 := s1.dialer()
+	d1.MaxRecipients = 1
+	f := NewFailoverDialer(d1, s2.dialer())
+
+	s, err := f.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var serr *Error
+	if err := s.Send(testFrom, []string{testTo1, testTo2}, getTestMessage()); !errors.As(err, &serr) || serr.Code != 451 {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if n := len(s1.messages()); n != 1 {
+		t.Errorf("The email should be sent to the first recipient, got %d emails", n)
+	}
+	if n := s2.connections(); n != 0 {
+		t.Errorf("An email sent to some recipients should not fail over, got %d connections", n)
+	}
+}
+
+func TestFailoverDialerTimeout(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	d1 := s1.dialer()
+	d1.Timeout = 50 * time.Millisecond
+	f := NewFailoverDialer(d1, s2.dialer())
+
+	// The first server does not answer, like a host dropping the packets.
+	dial := netDialContext
+	netDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == s1.l.Addr().String() {
+			<-ctx.Done()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		}
+		return dial(ctx, network, address)
+	}
+	t.Cleanup(func() { netDialContext = dial })
+
+	if err := f.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s2.messages()); n != 1 {
+		t.Errorf("The email should be sent to the second server, got %d emails", n)
+	}
+	if s := f.Status()[0]; s.Healthy || s.Failures != 1 {
+		t.Errorf("The first server should be unhealthy, got %+v", s)
+	}
+}
@@ -0,0 +1,252 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A Resolver looks up the MX records of a domain and the IPv4 and IPv6
+// addresses of its SMTP servers. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// An MXSender delivers emails directly to the SMTP servers of the domains of
+// their recipients, as found in the MX records of the domains, without
+// relaying them through another SMTP server.
+type MXSender struct {
+	// Dialer is used to connect to the SMTP servers, its Host and Port fields
+	// are replaced for each server. It should not authenticate and its
+	// LocalName should be the hostname of the machine, since the servers may
+	// check it. By default, a Dialer using STARTTLS when it is supported is
+	// used.
+	//
+	// With TLSOpportunistic, a server whose certificate cannot be verified is
+	// connected to again without verifying it: as recommended by RFC 7435, an
+	// unauthenticated encryption is still better than none, and many servers
+	// do not have a certificate matching their MX name.
+	Dialer *Dialer
+	// Resolver is used to look up the MX records and the addresses of the
+	// servers. By default, net.DefaultResolver is used.
+	Resolver Resolver
+	// Port is the port of the SMTP servers. By default, 25.
+	Port int
+}
+
+// A DomainResult is the result of the delivery of an email to the recipients
+// of a domain.
+type DomainResult struct {
+	Domain string
+	// Recipients contains the recipients of the domain.
+	Recipients []string
+	// Host is the SMTP server which received the email, or the last one that
+	// was tried if the delivery failed.
+	Host string
+	// Result contains the replies of the server to the recipients, if the
+	// server was reached.
+	Result *Result
+	// Err is the error which prevented the delivery, if any.
+	Err error
+}
+
+// A DeliveryError is returned by MXSender when an email could not be
+// delivered to the recipients of some domains. It was delivered to the other
+// ones.
+type DeliveryError struct {
+	Results []DomainResult
+}
+
+func (e *DeliveryError) Error() string {
+	var failed []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed = append(failed, r.Domain+": "+r.Err.Error())
+		}
+	}
+	return fmt.Sprintf("gomail: could not deliver email to %d of %d domains: %s", len(failed), len(e.Results), strings.Join(failed, "; "))
+}
+
+// Send implements send.Sender.
+func (s *MXSender) Send(from string, to []string, msg io.WriterTo) error {
+	return s.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements send.ContextSender.
+func (s *MXSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return s.SendEnvelope(ctx, &send.Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements send.EnvelopeSender. If the email was delivered to
+// every domain but some recipients were rejected, which only happens when
+// Dialer.SkipRejectedRecipients is set, a *RejectedRecipientsError is
+// returned.
+func (s *MXSender) SendEnvelope(ctx context.Context, env *send.Envelope, msg io.WriterTo) error {
+	res := s.Deliver(ctx, env, msg)
+	all := &Result{}
+	for _, r := range res {
+		if r.Err != nil {
+			return &DeliveryError{Results: res}
+		}
+		all = all.add(r.Result)
+	}
+	return resultError(all, nil)
+}
+
+// Deliver sends an email to the recipients of env, grouped by domain, and
+// returns the result for each domain. The servers of a domain are tried in
+// order of preference, at each of their addresses, until one of them accepts
+// or permanently rejects the email.
+func (s *MXSender) Deliver(ctx context.Context, env *send.Envelope, msg io.WriterTo) []DomainResult {
+	var res []DomainResult
+	index := make(map[string]int)
+	for _, rcpt := range env.To {
+		domain := ""
+		if i := strings.LastIndexByte(rcpt, '@'); i != -1 {
+			domain = strings.ToLower(rcpt[i+1:])
+		}
+		i, ok := index[domain]
+		if !ok {
+			i = len(res)
+			index[domain] = i
+			res = append(res, DomainResult{Domain: domain})
+		}
+		res[i].Recipients = append(res[i].Recipients, rcpt)
+	}
+
+	for i := range res {
+		r := &res[i]
+		if r.Domain == "" {
+			r.Err = fmt.Errorf("gomail: invalid recipients %q", r.Recipients)
+			continue
+		}
+		e := *env
+		e.To = r.Recipients
+		s.deliver(ctx, r, &e, msg)
+	}
+	return res
+}
+
+// deliver sends an email to the recipients of a domain.
+func (s *MXSender) deliver(ctx context.Context, r *DomainResult, env *send.Envelope, msg io.WriterTo) {
+	hosts, err := s.lookupHosts(ctx, r.Domain)
+	if err != nil {
+		r.Err = err
+		return
+	}
+
+	for _, host := range hosts {
+		r.Host = host
+		ips, err := s.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			r.Err = err
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		for _, ip := range ips {
+			sc, err := s.dial(ctx, host, ip.String())
+			if err != nil {
+				// Another address or server may be reachable.
+				r.Err = err
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			var sent bool
+			r.Result, sent, r.Err = sc.sendEnvelope(ctx, env, msg)
+			sc.Close()
+			// The recipients of the transactions that succeeded would
+			// receive the email twice.
+			if r.Err == nil || sent || ctx.Err() != nil || !canTryNextHost(r.Err) {
+				return
+			}
+		}
+	}
+}
+
+// canTryNextHost reports whether the email may be accepted by another server
+// after err, which was returned while sending it: the connection was broken or
+// the server replied with a temporary error. The other errors, such as the
+// ones of the content of the email, would happen with any server.
+func canTryNextHost(err error) bool {
+	var serr *Error
+	if errors.As(err, &serr) {
+		return serr.IsTemporary()
+	}
+	// net.Error is not used since syscall.Errno implements it, including for
+	// the errors of local files.
+	var oerr *net.OpError
+	return errors.As(err, &oerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dial connects to an SMTP server of a domain at one of its addresses.
+func (s *MXSender) dial(ctx context.Context, host, ip string) (*smtpSender, error) {
+	var d Dialer
+	if s.Dialer != nil {
+		d = *s.Dialer
+	}
+	d.Host = host
+	d.ip = ip
+	d.Port = s.Port
+	if d.Port == 0 {
+		d.Port = 25
+	}
+	if d.TLSConfig != nil {
+		d.TLSConfig = d.TLSConfig.Clone()
+		d.TLSConfig.ServerName = host
+	}
+
+	sc, err := d.dial(ctx)
+	var verr *tls.CertificateVerificationError
+	if err != nil && d.tlsPolicy() == TLSOpportunistic && errors.As(err, &verr) && ctx.Err() == nil {
+		d.TLSConfig = d.tlsConfig().Clone()
+		d.TLSConfig.InsecureSkipVerify = true
+		return d.dial(ctx)
+	}
+	return sc, err
+}
+
+// lookupHosts returns the SMTP servers of a domain, from the most to the least
+// preferred. The domain itself is used if it has no MX records, as defined in
+// RFC 5321, section 5.1.
+func (s *MXSender) lookupHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := s.resolver().LookupMX(ctx, domain)
+	var derr *net.DNSError
+	if (errors.As(err, &derr) && derr.IsNotFound) || (err == nil && len(mxs) == 0) {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A single MX record with the host "." means that the domain does not
+	// accept emails, see RFC 7505.
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, fmt.Errorf("gomail: domain %s does not accept emails", domain)
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+func (s *MXSender) resolver() Resolver {
+	if s.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return s.Resolver
+}
@@ -0,0 +1,333 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"github.com/hacku7/gomail/send"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	addrs map[string][]string
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r.mx[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ips := make([]net.IPAddr, len(addrs))
+	for i, a := range addrs {
+		ips[i] = net.IPAddr{IP: net.ParseIP(a)}
+	}
+	return ips, nil
+}
+
+// stubHosts makes the connections to the given addresses reach the fake
+// servers. The other addresses cannot be reached.
+func stubHosts(t *testing.T, hosts map[string]*fakeServer) {
+	dial := netDialContext
+	netDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := hosts[host]
+		if !ok {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		}
+		s.dialer()
+		return dial(ctx, network, s.l.Addr().String())
+	}
+	t.Cleanup(func() { netDialContext = dial })
+}
+
+func TestMXSender(t *testing.T) {
+	const toOrg = "user@example.org"
+	mx1, mx2, org := newFakeServer(t), newFakeServer(t), newFakeServer(t)
+	stubHosts(t, map[string]*fakeServer{
+		"192.0.2.1": mx1,
+		"192.0.2.2": mx2,
+		"192.0.2.3": org,
+	})
+	s := &MXSender{Resolver: fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		},
+		addrs: map[string][]string{
+			"mx1.example.com": {"192.0.2.1"},
+			"mx2.example.com": {"192.0.2.2"},
+			"example.org":     {"192.0.2.3"},
+		},
+	}}
+
+	env := &send.Envelope{From: testFrom, To: []string{testTo1, toOrg, testTo2}}
+	res := s.Deliver(context.Background(), env, getTestMessage())
+
+	if len(res) != 2 {
+		t.Fatalf("Invalid number of domains, got %d, want 2", len(res))
+	}
+	for i, want := range []DomainResult{
+		{Domain: "example.com", Recipients: []string{testTo1, testTo2}, Host: "mx1.example.com"},
+		{Domain: "example.org", Recipients: []string{toOrg}, Host: "example.org"},
+	} {
+		got := res[i]
+		if got.Domain != want.Domain || !reflect.DeepEqual(got.Recipients, want.Recipients) || got.Host != want.Host || got.Err != nil {
+			t.Errorf("Invalid result for %s, got %+v, want %+v", want.Domain, got, want)
+		}
+		if got.Result == nil || len(got.Result.Accepted) != len(want.Recipients) {
+			t.Errorf("Invalid recipients result for %s, got %+v", want.Domain, got.Result)
+		}
+	}
+	if n := len(mx1.messages()); n != 1 {
+		t.Errorf("The email should be sent to the preferred server, got %d emails", n)
+	}
+	if n := mx2.connections(); n != 0 {
+		t.Errorf("The other server should not be used, got %d connections", n)
+	}
+	if !hasCommand(org, "RCPT TO:<"+toOrg+">") || hasCommand(org, "RCPT TO:<"+testTo1+">") {
+		t.Errorf("Invalid commands, got %q", org.commands())
+	}
+}
+
+func TestMXSenderFailover(t *testing.T) {
+	mx2, mx3 := newFakeServer(t), newFakeServer(t)
+	mx2.reply = func(cmd string) string {
+		if cmd == greeting {
+			return "421 4.3.2 Service not available"
+		}
+		return ""
+	}
+	stubHosts(t, map[string]*fakeServer{
+		"192.0.2.2": mx2,
+		"192.0.2.3": mx3,
+	})
+	s := &MXSender{Resolver: fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx3.example.com.", Pref: 30},
+			},
+		},
+		addrs: map[string][]string{
+			"mx1.example.com": {"192.0.2.1"},
+			"mx2.example.com": {"192.0.2.2"},
+			"mx3.example.com": {"192.0.2.3"},
+		},
+	}}
+
+	if err := s.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mx3.messages()); n != 1 {
+		t.Errorf("The email should be sent to the last server, got %d emails", n)
+	}
+}
+
+func TestMXSenderPermanentError(t *testing.T) {
+	mx1, mx2 := newFakeServer(t), newFakeServer(t)
+	mx1.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "RCPT") {
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	}
+	stubHosts(t, map[string]*fakeServer{
+		"192.0.2.1": mx1,
+		"192.0.2.2": mx2,
+	})
+	s := &MXSender{Resolver: fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+			"example.net": {{Host: ".", Pref: 0}},
+		},
+		addrs: map[string][]string{
+			"mx1.example.com": {"192.0.2.1"},
+			"mx2.example.com": {"192.0.2.2"},
+		},
+	}}
+
+	err := s.Send(testFrom, []string{testTo1, "user@example.net"}, getTestMessage())
+	derr, ok := err.(*DeliveryError)
+	if !ok {
+		t.Fatalf("Invalid error, got %#v, want a *DeliveryError", err)
+	}
+	var serr *Error
+	if r := derr.Results[0]; !errors.As(r.Err, &serr) || serr.Code != 550 || r.Host != "mx1.example.com" {
+		t.Errorf("Invalid result for example.com, got %+v", r)
+	}
+	if r := derr.Results[1]; r.Err == nil || r.Host != "" {
+		t.Errorf("A null MX should reject the email, got %+v", r)
+	}
+	if n := mx2.connections(); n != 0 {
+		t.Errorf("A permanent error should not be retried with another server, got %d connections", n)
+	}
+}
+
+func TestMXSenderLocalError(t *testing.T) {
+	mx1, mx2 := newFakeServer(t), newFakeServer(t)
+	stubHosts(t, map[string]*fakeServer{
+		"192.0.2.1": mx1,
+		"192.0.2.2": mx2,
+	})
+	s := &MXSender{Resolver: fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+		},
+		addrs: map[string][]string{
+			"mx1.example.com": {"192.0.2.1"},
+			"mx2.example.com": {"192.0.2.2"},
+		},
+	}}
+
+	m := getTestMessage()
+	m.Attach("/does/not/exist.pdf")
+	err := s.Send(testFrom, []string{testTo1}, m)
+	derr, ok := err.(*DeliveryError)
+	if !ok {
+		t.Fatalf("Invalid error, got %#v, want a *DeliveryError", err)
+	}
+	if r := derr.Results[0]; !errors.Is(r.Err, os.ErrNotExist) || r.Host != "mx1.example.com" {
+		t.Errorf("Invalid result for example.com, got %+v", r)
+	}
+	if n := mx2.connections(); n != 0 {
+		t.Errorf("A local error should not be retried with another server, got %d connections", n)
+	}
+}
+
+func TestMXSenderRejectedRecipients(t *testing.T) {
+	mx1 := newFakeServer(t)
+	mx1.reply = rejectBadRecipient
+	stubHosts(t, map[string]*fakeServer{"192.0.2.1": mx1})
+	s := &MXSender{
+		Dialer: &Dialer{SkipRejectedRecipients: true},
+		Resolver: fakeResolver{
+			mx:    map[string][]*net.MX{"example.com": {{Host: "mx1.example.com.", Pref: 10}}},
+			addrs: map[string][]string{"mx1.example.com": {"192.0.2.1"}},
+		},
+	}
+
+	err := s.Send(testFrom, []string{testTo1, testBadTo}, getTestMessage())
+	rerr, ok := err.(*RejectedRecipientsError)
+	if !ok {
+		t.Fatalf("Invalid error, got %#v, want a *RejectedRecipientsError", err)
+	}
+	if len(rerr.Result.Accepted) != 1 || len(rerr.Result.Rejected) != 1 || rerr.Result.Rejected[0].Address != testBadTo {
+		t.Errorf("Invalid result, got %+v", rerr.Result)
+	}
+	if n := len(mx1.messages()); n != 1 {
+		t.Errorf("The email should be sent to the accepted recipients, got %d emails", n)
+	}
+}
+
+func TestMXSenderAddresses(t *testing.T) {
+	mx2 := newFakeServer(t)
+	stubHosts(t, map[string]*fakeServer{"192.0.2.2": mx2})
+	s := &MXSender{Resolver: fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx0.example.com.", Pref: 0},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+			},
+		},
+		addrs: map[string][]string{
+			"mx1.example.com": {"2001:db8::1"},
+			"mx2.example.com": {"2001:db8::2", "192.0.2.2"},
+		},
+	}}
+
+	env := &send.Envelope{From: testFrom, To: []string{testTo1}}
+	res := s.Deliver(context.Background(), env, getTestMessage())
+	if r := res[0]; r.Err != nil || r.Host != "mx2.example.com" {
+		t.Errorf("Invalid result, got %+v", r)
+	}
+	if n := len(mx2.messages()); n != 1 {
+		t.Errorf("The email should be sent to the IPv4 address of the last server, got %d emails", n)
+	}
+}
+
+func TestMXSenderUntrustedCertificate(t *testing.T) {
+	for _, policy := range []TLSPolicy{TLSOpportunistic, TLSMandatory} {
+		mx1 := newFakeServer(t)
+		mx1.useTLS(false)
+		stubHosts(t, map[string]*fakeServer{"192.0.2.1": mx1})
+		s := &MXSender{
+			Dialer: &Dialer{TLSPolicy: policy},
+			Resolver: fakeResolver{
+				mx:    map[string][]*net.MX{"example.com": {{Host: "mx1.example.com.", Pref: 10}}},
+				addrs: map[string][]string{"mx1.example.com": {"192.0.2.1"}},
+			},
+		}
+
+		err := s.Send(testFrom, []string{testTo1}, getTestMessage())
+		if policy == TLSMandatory {
+			if err == nil || !strings.Contains(err.Error(), "certificate") {
+				t.Errorf("Send() should fail with an untrusted certificate and %v, got %v", policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countCommands(mx1.commands(), "STARTTLS"); n != 2 {
+			t.Errorf("The connection should be encrypted again without verifying the certificate, got %d STARTTLS", n)
+		}
+		if n := len(mx1.messages()); n != 1 {
+			t.Errorf("The email should be sent, got %d emails", n)
+		}
+	}
+}
+
+func TestMXSenderMaxRecipients(t *testing.T) {
+	mx1, mx2 := newFakeServer(t), newFakeServer(t)
+	mails := 0
+	mx1.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			if mails++; mails > 1 {
+				return "451 4.3.0 Try again later"
+			}
+		}
+		return ""
+	}
+	stubHosts(t, map[string]*fakeServer{
+		"192.0.2.1": mx1,
+		"192.0.2.2": mx2,
+	})
+	s := &MXSender{
+		Dialer: &Dialer{MaxRecipients: 1},
+		Resolver: fakeResolver{
+			mx: map[string][]*net.MX{
+				"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+			},
+			addrs: map[string][]string{
+				"mx1.example.com": {"192.0.2.1"},
+				"mx2.example.com": {"192.0.2.2"},
+			},
+		},
+	}
+
+	if err := s.Send(testFrom, []string{testTo1, testTo2}, getTestMessage()); err == nil {
+		t.Error("Send() should fail")
+	}
+	if n := len(mx1.messages()); n != 1 {
+		t.Errorf("The email should be sent to the first recipient, got %d emails", n)
+	}
+	if n := mx2.connections(); n != 0 {
+		t.Errorf("An email sent to some recipients should not be sent to another server, got %d connections", n)
+	}
+}
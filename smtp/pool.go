@@ -0,0 +1,315 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when sending an email with a closed Pool.
+var ErrPoolClosed = errors.New("gomail: pool is closed")
+
+const defaultMaxIdle = 2
+
+// A Pool is a pool of connections to an SMTP server. It implements
+// send.SendCloser and, unlike the SendCloser returned by Dialer.Dial, it is
+// safe for concurrent use by multiple goroutines: each email is sent with a
+// connection borrowed from the pool.
+//
+// Idle connections are checked with the NOOP command before being reused.
+type Pool struct {
+	// Dialer is used to open the connections.
+	Dialer *Dialer
+	// MaxOpen is the maximum number of open connections. If it is reached,
+	// sending an email waits for a connection to be available. By default,
+	// there is no limit.
+	MaxOpen int
+	// MaxIdle is the maximum number of idle connections kept in the pool. By
+	// default, 2 idle connections are kept. If it is negative, no idle
+	// connections are kept.
+	MaxIdle int
+	// IdleTimeout is the maximum amount of time a connection may be idle
+	// before being closed. The idle connections are closed in the background
+	// once it is reached. By default, idle connections are not closed.
+	IdleTimeout time.Duration
+	// MaxMessagesPerConn is the maximum number of emails sent with a
+	// connection before closing it. By default, there is no limit.
+	MaxMessagesPerConn int
+
+	mu      sync.Mutex
+	idle    []*pooledConn
+	open    int
+	waiters []chan *pooledConn
+	closed  bool
+	reaper  *time.Timer
+}
+
+type pooledConn struct {
+	s        *smtpSender
+	sent     int
+	lastUsed time.Time
+}
+
+// PoolStats contains the statistics of a Pool.
+type PoolStats struct {
+	// Open is the number of open connections, in use or idle.
+	Open int
+	// Idle is the number of idle connections.
+	Idle int
+	// Waiting is the number of emails waiting for a connection.
+	Waiting int
+}
+
+// NewPool returns a new Pool of connections opened with the given Dialer.
+func NewPool(d *Dialer) *Pool {
+	return &Pool{Dialer: d}
+}
+
+// Send implements send.Sender.
+func (p *Pool) Send(from string, to []string, msg io.WriterTo) error {
+	return p.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements send.ContextSender. ctx bounds both the wait for a
+// connection and the sending of the email.
+func (p *Pool) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return resultError(p.SendResult(ctx, from, to, msg))
+}
+
+// SendResult implements ResultSender.
+func (p *Pool) SendResult(ctx context.Context, from string, to []string, msg io.WriterTo) (*Result, error) {
+	return p.SendEnvelopeResult(ctx, &send.Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements send.EnvelopeSender.
+func (p *Pool) SendEnvelope(ctx context.Context, env *send.Envelope, msg io.WriterTo) error {
+	return resultError(p.SendEnvelopeResult(ctx, env, msg))
+}
+
+// SendEnvelopeResult implements ResultSender.
+func (p *Pool) SendEnvelopeResult(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, error) {
+	pc, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := pc.s.SendEnvelopeResult(ctx, env, msg)
+	pc.sent++
+	p.put(pc)
+	return res, err
+}
+
+// Stats returns the statistics of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Open:    p.open,
+		Idle:    len(p.idle),
+		Waiting: len(p.waiters),
+	}
+}
+
+// Close closes the idle connections and prevents new emails from being sent.
+// The connections in use are closed once their email is sent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	if p.reaper != nil {
+		p.reaper.Stop()
+		p.reaper = nil
+	}
+	for _, w := range p.waiters {
+		w <- nil
+	}
+	p.waiters = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, pc := range idle {
+		if cerr := pc.s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (p *Pool) get(ctx context.Context) (*pooledConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+
+			if p.expired(pc) || pc.s.noop() != nil {
+				pc.s.conn.Close()
+				p.mu.Lock()
+				p.release()
+				continue
+			}
+			return pc, nil
+		}
+
+		if p.MaxOpen <= 0 || p.open < p.MaxOpen {
+			p.open++
+			p.mu.Unlock()
+			return p.dial(ctx)
+		}
+
+		req := make(chan *pooledConn, 1)
+		p.waiters = append(p.waiters, req)
+		p.mu.Unlock()
+
+		select {
+		case pc := <-req:
+			if pc != nil {
+				return pc, nil
+			}
+			p.mu.Lock()
+			if p.closed {
+				p.mu.Unlock()
+				return nil, ErrPoolClosed
+			}
+			p.mu.Unlock()
+			// A connection was closed and its slot was handed to us.
+			return p.dial(ctx)
+		case <-ctx.Done():
+			p.mu.Lock()
+			if p.removeWaiter(req) {
+				p.mu.Unlock()
+				return nil, ctx.Err()
+			}
+			// A connection or a slot was handed to us in the meantime.
+			pc := <-req
+			if pc == nil && !p.closed {
+				p.release()
+			}
+			p.mu.Unlock()
+			if pc != nil {
+				p.put(pc)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *Pool) dial(ctx context.Context) (*pooledConn, error) {
+	s, err := p.Dialer.dial(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.release()
+		p.mu.Unlock()
+		return nil, err
+	}
+	return &pooledConn{s: s}, nil
+}
+
+// put gives back a connection to the pool once an email has been sent with
+// it.
+func (p *Pool) put(pc *pooledConn) {
+	// The connection was reset or closed by the sender after a failure.
+	healthy := !pc.s.broken
+	retired := p.MaxMessagesPerConn > 0 && pc.sent >= p.MaxMessagesPerConn
+
+	p.mu.Lock()
+	if healthy && !retired && !p.closed {
+		pc.lastUsed = time.Now()
+		if len(p.waiters) > 0 {
+			w := p.waiters[0]
+			p.waiters = p.waiters[1:]
+			w <- pc
+			p.mu.Unlock()
+			return
+		}
+		if len(p.idle) < p.maxIdle() {
+			p.idle = append(p.idle, pc)
+			p.scheduleReap()
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.release()
+	p.mu.Unlock()
+
+	pc.s.Close()
+}
+
+// release must be called with p.mu held when a connection is closed. Its slot
+// is handed to the first waiter, if any.
+func (p *Pool) release() {
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- nil
+		return
+	}
+	p.open--
+}
+
+// scheduleReap must be called with p.mu held. It starts a timer closing the
+// oldest idle connection once it expires, if no timer is running.
+func (p *Pool) scheduleReap() {
+	if p.IdleTimeout <= 0 || p.reaper != nil || p.closed || len(p.idle) == 0 {
+		return
+	}
+	p.reaper = time.AfterFunc(p.IdleTimeout-time.Since(p.idle[0].lastUsed), p.reap)
+}
+
+// reap closes the expired idle connections. The idle connections are sorted
+// from the least to the most recently used.
+func (p *Pool) reap() {
+	p.mu.Lock()
+	var expired []*pooledConn
+	for len(p.idle) > 0 && p.expired(p.idle[0]) {
+		expired = append(expired, p.idle[0])
+		p.idle = p.idle[1:]
+		p.release()
+	}
+	p.reaper = nil
+	p.scheduleReap()
+	p.mu.Unlock()
+
+	for _, pc := range expired {
+		pc.s.Close()
+	}
+}
+
+func (p *Pool) removeWaiter(req chan *pooledConn) bool {
+	for i, w := range p.waiters {
+		if w == req {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) expired(pc *pooledConn) bool {
+	return p.IdleTimeout > 0 && time.Since(pc.lastUsed) >= p.IdleTimeout
+}
+
+func (p *Pool) maxIdle() int {
+	switch {
+	case p.MaxIdle < 0:
+		return 0
+	case p.MaxIdle == 0:
+		return defaultMaxIdle
+	}
+	return p.MaxIdle
+}
@@ -0,0 +1,252 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countCommands(cmds []string, prefix string) int {
+	n := 0
+	for _, c := range cmds {
+		if strings.HasPrefix(c, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPoolReuse(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.MaxOpen = 1
+
+	for i := 0; i < 3; i++ {
+		if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := s.commands()
+	if n := s.connections(); n != 1 {
+		t.Errorf("Invalid number of connections, got %d, want 1", n)
+	}
+	if n := countCommands(cmds, "NOOP"); n != 2 {
+		t.Errorf("Invalid number of NOOP, got %d, want 2", n)
+	}
+	if n := countCommands(cmds, "MAIL"); n != 3 {
+		t.Errorf("Invalid number of MAIL, got %d, want 3", n)
+	}
+	if n := countCommands(cmds, "QUIT"); n != 1 {
+		t.Errorf("Invalid number of QUIT, got %d, want 1", n)
+	}
+	if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != ErrPoolClosed {
+		t.Errorf("Send() should fail after Close(), got %v", err)
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.MaxOpen = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats := p.Stats(); stats.Open > 2 || stats.Idle != stats.Open || stats.Waiting != 0 {
+		t.Errorf("Invalid stats %+v", stats)
+	}
+	p.Close()
+
+	if n := s.connections(); n > 2 {
+		t.Errorf("Invalid number of connections, got %d, want at most 2", n)
+	}
+	if n := countCommands(s.commands(), "MAIL"); n != 20 {
+		t.Errorf("Invalid number of MAIL, got %d, want 20", n)
+	}
+}
+
+func TestPoolMaxMessagesPerConn(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.MaxMessagesPerConn = 2
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.connections(); n != 2 {
+		t.Errorf("Invalid number of connections, got %d, want 2", n)
+	}
+	if n := countCommands(s.commands(), "QUIT"); n != 1 {
+		t.Errorf("Invalid number of QUIT, got %d, want 1", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.IdleTimeout = 10 * time.Millisecond
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	if n := s.connections(); n != 2 {
+		t.Errorf("Invalid number of connections, got %d, want 2", n)
+	}
+}
+
+func TestPoolReapIdle(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.IdleTimeout = 10 * time.Millisecond
+	defer p.Close()
+
+	if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); countCommands(s.commands(), "QUIT") == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("The idle connection should be closed")
+		}
+	}
+	if stats := p.Stats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Errorf("Invalid stats %+v", stats)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == "NOOP" {
+			return "421 Service not available"
+		}
+		return ""
+	}
+	p := NewPool(s.dialer())
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.connections(); n != 2 {
+		t.Errorf("Invalid number of connections, got %d, want 2", n)
+	}
+}
+
+func TestPoolRecoverAfterError(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == "RCPT TO:<"+testTo2+">" {
+			return "550 No such user"
+		}
+		return ""
+	}
+	p := NewPool(s.dialer())
+	defer p.Close()
+
+	if err := p.Send(testFrom, []string{testTo2}, getTestMessage()); err == nil {
+		t.Fatal("Send() should fail")
+	}
+	if err := p.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.connections(); n != 1 {
+		t.Errorf("Invalid number of connections, got %d, want 1", n)
+	}
+	if n := countCommands(s.commands(), "RSET"); n != 1 {
+		t.Errorf("Invalid number of RSET, got %d, want 1", n)
+	}
+}
+
+func TestPoolWaitContext(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			return hang
+		}
+		return ""
+	}
+	p := NewPool(s.dialer())
+	p.MaxOpen = 1
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go p.SendContext(ctx, testFrom, []string{testTo1}, getTestMessage())
+	for p.Stats().Open == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel2()
+	if err := p.SendContext(ctx2, testFrom, []string{testTo1}, getTestMessage()); err != context.DeadlineExceeded {
+		t.Errorf("SendContext() should exceed its deadline, got %v", err)
+	}
+	if stats := p.Stats(); stats.Waiting != 0 {
+		t.Errorf("Invalid stats %+v", stats)
+	}
+}
+
+func TestPoolWaitContextHandOff(t *testing.T) {
+	s := newFakeServer(t)
+	p := NewPool(s.dialer())
+	p.MaxOpen = 1
+	p.MaxIdle = -1
+	defer p.Close()
+
+	pc, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := p.get(ctx)
+		done <- err
+	}()
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Hand the connection off to the waiter once its context is done.
+	p.mu.Lock()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	p.waiters[0] <- pc
+	p.waiters = p.waiters[1:]
+	p.mu.Unlock()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Invalid error, got %v", err)
+	}
+	if stats := p.Stats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Errorf("The connection should be closed since no idle connection is kept, got stats %+v", stats)
+	}
+}
@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hacku7/gomail/send"
+	"io"
+	"strings"
+)
+
+// A RecipientResult is the reply of the SMTP server to the RCPT command for a
+// recipient.
+type RecipientResult struct {
+	Address string
+	// Code is the SMTP reply code, for example 250 or 550.
+	Code int
+	// EnhancedCode is the enhanced status code defined in RFC 3463, for
+	// example "2.1.5", or "" if the server did not send one.
+	EnhancedCode string
+	// Message is the text of the reply, without the enhanced status code.
+	Message string
+}
+
+func recipientResult(addr string, code int, text string) RecipientResult {
+	enhanced, text := splitEnhancedCode(text)
+	return RecipientResult{
+		Address:      addr,
+		Code:         code,
+		EnhancedCode: enhanced,
+		Message:      text,
+	}
+}
+
+// A Result lists the recipients of an email accepted and rejected by the SMTP
+// server.
+type Result struct {
+	Accepted []RecipientResult
+	Rejected []RecipientResult
+}
+
+// add returns r with the recipients of other added. r may be nil.
+func (r *Result) add(other *Result) *Result {
+	if other == nil {
+		return r
+	}
+	if r == nil {
+		return other
+	}
+	r.Accepted = append(r.Accepted, other.Accepted...)
+	r.Rejected = append(r.Rejected, other.Rejected...)
+	return r
+}
+
+// A ResultSender can send an email and report the result for each recipient.
+// It is implemented by the SendCloser returned by Dialer.Dial and by Pool.
+//
+// SendEnvelopeResult is like SendResult but uses the addresses and parameters
+// of env, see send.EnvelopeSender.
+type ResultSender interface {
+	SendResult(ctx context.Context, from string, to []string, msg io.WriterTo) (*Result, error)
+	SendEnvelopeResult(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, error)
+}
+
+// A RejectedRecipientsError is returned by Send when some recipients were
+// rejected and Dialer.SkipRejectedRecipients is set. The email was sent to the
+// accepted recipients, if any.
+type RejectedRecipientsError struct {
+	Result *Result
+}
+
+func (e *RejectedRecipientsError) Error() string {
+	rejected := make([]string, len(e.Result.Rejected))
+	for i, r := range e.Result.Rejected {
+		reply := fmt.Sprintf("%03d", r.Code)
+		if r.EnhancedCode != "" {
+			reply += " " + r.EnhancedCode
+		}
+		rejected[i] = fmt.Sprintf("%s (%s %s)", r.Address, reply, r.Message)
+	}
+	total := len(e.Result.Accepted) + len(e.Result.Rejected)
+	return fmt.Sprintf("gomail: %d of %d recipients rejected: %s",
+		len(e.Result.Rejected), total, strings.Join(rejected, ", "))
+}
+
+// resultError returns the error reported by Send for the given result.
+func resultError(res *Result, err error) error {
+	if err == nil && res != nil && len(res.Rejected) > 0 {
+		return &RejectedRecipientsError{Result: res}
+	}
+	return err
+}
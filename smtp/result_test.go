@@ -0,0 +1,305 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"github.com/hacku7/gomail/send"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBadTo = "bad@example.com"
+
+func rejectBadRecipient(cmd string) string {
+	if cmd == "RCPT TO:<"+testBadTo+">" {
+		return "550 5.1.1 No such user"
+	}
+	return ""
+}
+
+func hasCommand(s *fakeServer, cmd string) bool {
+	for _, c := range s.commands() {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendResult(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	res, err := sc.(ResultSender).SendResult(context.Background(), testFrom, []string{testTo1, testBadTo, testTo2}, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Result{
+		Accepted: []RecipientResult{
+			{Address: testTo1, Code: 250, Message: "OK"},
+			{Address: testTo2, Code: 250, Message: "OK"},
+		},
+		Rejected: []RecipientResult{
+			{Address: testBadTo, Code: 550, EnhancedCode: "5.1.1", Message: "No such user"},
+		},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Invalid result, got %+v, want %+v", res, want)
+	}
+	if !hasCommand(s, "DATA") {
+		t.Error("The email should be sent to the accepted recipients")
+	}
+}
+
+func TestSendRejectedRecipients(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testTo1, testBadTo}, getTestMessage())
+	rerr, ok := err.(*RejectedRecipientsError)
+	if !ok {
+		t.Fatalf("Invalid error, got %#v, want a *RejectedRecipientsError", err)
+	}
+	if n := len(rerr.Result.Accepted); n != 1 {
+		t.Errorf("Invalid number of accepted recipients, got %d, want 1", n)
+	}
+	want := "gomail: 1 of 2 recipients rejected: bad@example.com (550 5.1.1 No such user)"
+	if err.Error() != want {
+		t.Errorf("Invalid error message, got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestSendAllRecipientsRejected(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testBadTo}, getTestMessage())
+	if _, ok := err.(*RejectedRecipientsError); !ok {
+		t.Fatalf("Invalid error, got %#v, want a *RejectedRecipientsError", err)
+	}
+	if hasCommand(s, "DATA") {
+		t.Error("DATA should not be sent without recipients")
+	}
+	if !hasCommand(s, "RSET") {
+		t.Error("The transaction should be reset")
+	}
+
+	// The connection is still usable.
+	if err := sc.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendRecipientRejectedByDefault(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+
+	m := getTestMessage()
+	m.SetHeader("To", testBadTo, testTo1)
+	err := d.DialAndSend(m)
+	var terr *textproto.Error
+	if !errors.As(err, &terr) || terr.Code != 550 {
+		t.Errorf("Invalid error, got %#v, want a 550 *textproto.Error", err)
+	}
+	if hasCommand(s, "RCPT TO:<"+testTo1+">") || hasCommand(s, "DATA") {
+		t.Errorf("Send should stop at the first rejected recipient, got %q", s.commands())
+	}
+}
+
+func TestPoolSendResult(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = rejectBadRecipient
+	d := s.dialer()
+	d.SkipRejectedRecipients = true
+	p := NewPool(d)
+	defer p.Close()
+
+	for _, to := range [][]string{{testBadTo}, {testTo1, testBadTo}} {
+		res, err := p.SendResult(context.Background(), testFrom, to, getTestMessage())
+		if len(to) == 1 && err == nil {
+			t.Error("SendResult() should fail without any accepted recipient")
+		}
+		if len(to) == 2 && err != nil {
+			t.Error(err)
+		}
+		if n := len(res.Rejected); n != 1 {
+			t.Errorf("Invalid number of rejected recipients, got %d, want 1", n)
+		}
+	}
+
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+	if err := p.Send(testFrom, []string{testTo1, testBadTo}, getTestMessage()); err == nil || !strings.Contains(err.Error(), testBadTo) {
+		t.Errorf("Send() should report the rejected recipient, got %v", err)
+	}
+}
+
+func TestSendEnvelope(t *testing.T) {
+	const (
+		bounces  = "bounces@example.com"
+		redirect = "redirect@example.com"
+	)
+	s := newFakeServer(t, "PIPELINING")
+	p := NewPool(s.dialer())
+	defer p.Close()
+
+	env := &send.Envelope{
+		From:       bounces,
+		To:         []string{testTo1, redirect},
+		MailParams: []string{"RET=HDRS"},
+		RcptParams: map[string][]string{testTo1: {"NOTIFY=NEVER"}},
+	}
+	err := send.SendEnvelope(context.Background(), p, env, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"MAIL FROM:<" + bounces + "> RET=HDRS",
+		"RCPT TO:<" + testTo1 + "> NOTIFY=NEVER",
+		"RCPT TO:<" + redirect + ">",
+	} {
+		if !hasCommand(s, cmd) {
+			t.Errorf("Invalid commands, got %q, want %q", s.commands(), cmd)
+		}
+	}
+	if hasCommand(s, "RCPT TO:<"+testTo2+">") {
+		t.Error("The recipients of the header should not be used")
+	}
+
+	env.MailParams = []string{"RET=HDRS\r\nRSET"}
+	if err := send.SendEnvelope(context.Background(), p, env, getTestMessage()); err == nil {
+		t.Error("A parameter containing CR or LF should be rejected")
+	}
+}
+
+// limitRecipients makes the server reject the recipients of a transaction
+// after the first max ones with a 452 reply.
+func limitRecipients(max int) func(cmd string) string {
+	n := 0
+	return func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "MAIL"):
+			n = 0
+		case strings.HasPrefix(cmd, "RCPT"):
+			if reply := rejectBadRecipient(cmd); reply != "" {
+				return reply
+			}
+			if n++; n > max {
+				return "452 4.5.3 Too many recipients"
+			}
+		}
+		return ""
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	to := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	tests := []struct {
+		ext           []string
+		maxRecipients int
+		serverLimit   int
+	}{
+		{nil, 2, 10},
+		{nil, 0, 2},
+		{[]string{"PIPELINING"}, 0, 2},
+		{nil, 3, 2},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, test.ext...)
+		s.reply = limitRecipients(test.serverLimit)
+		d := s.dialer()
+		d.MaxRecipients = test.maxRecipients
+
+		sc, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := sc.(ResultSender).SendResult(context.Background(), testFrom, to, getTestMessage())
+		sc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, r := range res.Accepted {
+			got = append(got, r.Address)
+		}
+		if !reflect.DeepEqual(got, to) {
+			t.Errorf("Invalid accepted recipients with %+v, got %q, want %q", test, got, to)
+		}
+		if n := len(s.messages()); n != 3 {
+			t.Errorf("Invalid number of transactions with %+v, got %d, want 3", test, n)
+		}
+	}
+}
+
+func TestMaxRecipientsRejected(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = limitRecipients(2)
+	d := s.dialer()
+	d.MaxRecipients = 2
+	d.SkipRejectedRecipients = true
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testTo1, testTo2, testBadTo}, getTestMessage())
+	rerr, ok := err.(*RejectedRecipientsError)
+	if !ok {
+		t.Fatalf("Invalid error, got %#v, want a *RejectedRecipientsError", err)
+	}
+	if a, r := len(rerr.Result.Accepted), len(rerr.Result.Rejected); a != 2 || r != 1 {
+		t.Errorf("Invalid result, got %d accepted and %d rejected, want 2 and 1", a, r)
+	}
+	if n := countCommands(s.commands(), "MAIL"); n != 2 {
+		t.Errorf("Invalid number of transactions, got %d, want 2", n)
+	}
+}
+
+func TestTooManyRecipientsFirst(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = limitRecipients(0)
+	d := s.dialer()
+
+	err := d.DialAndSend(getTestMessage())
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Code != 452 || !serr.IsTemporary() {
+		t.Errorf("Invalid error, got %#v, want a 452 *Error", err)
+	}
+	if n := countCommands(s.commands(), "MAIL"); n != 1 {
+		t.Errorf("Invalid number of transactions, got %d, want 1", n)
+	}
+}
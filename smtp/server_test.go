@@ -0,0 +1,331 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// hang is the reply making the fake server stop answering.
+	hang = "hang"
+	// disconnect is the reply making the fake server close the connection.
+	disconnect = "disconnect"
+	// greeting is the command used to request the greeting of the server.
+	greeting = "<greeting>"
+)
+
+// fakeServer is an SMTP server listening on the loopback interface. It is used
+// to test the Dialer with the real net/smtp client.
+type fakeServer struct {
+	t *testing.T
+	l net.Listener
+	// ext contains the extensions advertised in the reply to EHLO.
+	ext []string
+	// tls enables the STARTTLS extension, or implicit TLS if implicitTLS is
+	// set.
+	tls         *tls.Config
+	implicitTLS bool
+	// stripStartTLS removes STARTTLS from the reply to EHLO, like an attacker
+	// downgrading the connection would do.
+	stripStartTLS bool
+	// reply returns the reply to a command, or "" to use the default reply.
+	// The greeting is requested with the greeting command and the end of the
+	// content of an email with ".".
+	reply func(cmd string) string
+
+	mu    sync.Mutex
+	cmds  []string
+	msgs  []string
+	conns int
+	wg    sync.WaitGroup
+	start sync.Once
+	quit  chan struct{}
+}
+
+func newFakeServer(t *testing.T, ext ...string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{t: t, l: l, ext: ext, quit: make(chan struct{})}
+	useRealNetwork(t)
+	t.Cleanup(s.close)
+	return s
+}
+
+// useRealNetwork restores the functions stubbed out by the other tests.
+func useRealNetwork(t *testing.T) {
+	dial, newTLSClient, handshake, newClient := netDialContext, tlsClient, tlsHandshake, smtpNewClient
+	netDialContext = (&net.Dialer{}).DialContext
+	tlsClient = tls.Client
+	tlsHandshake = func(ctx context.Context, conn *tls.Conn) error {
+		return conn.HandshakeContext(ctx)
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			return nil, err
+		}
+		return &client{c}, nil
+	}
+	t.Cleanup(func() {
+		netDialContext, tlsClient, tlsHandshake, smtpNewClient = dial, newTLSClient, handshake, newClient
+	})
+}
+
+// useTLS enables TLS on the server and returns the client TLS configuration
+// trusting its certificate.
+func (s *fakeServer) useTLS(implicit bool) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.tls = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+	s.implicitTLS = implicit
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+}
+
+// dialer starts the server, so it must be called once the server is
+// configured.
+func (s *fakeServer) dialer() *Dialer {
+	s.start.Do(func() {
+		s.wg.Add(1)
+		go s.serve()
+	})
+
+	addr := s.l.Addr().(*net.TCPAddr)
+	return &Dialer{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+// messages returns the content of the emails received with DATA or BDAT.
+func (s *fakeServer) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+func (s *fakeServer) receive(msg string) {
+	s.mu.Lock()
+	s.msgs = append(s.msgs, msg)
+	s.mu.Unlock()
+}
+
+// connections returns the number of connections accepted by the server.
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *fakeServer) close() {
+	close(s.quit)
+	s.l.Close()
+	s.wg.Wait()
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *fakeServer) handle(raw net.Conn) {
+	defer raw.Close()
+	go func() {
+		<-s.quit
+		raw.Close()
+	}()
+
+	conn := raw
+	secure := s.tls != nil && s.implicitTLS
+	if secure {
+		conn = tls.Server(conn, s.tls)
+	}
+
+	r := bufio.NewReader(conn)
+	write := func(reply string) bool {
+		if reply == hang {
+			// Wait for the client to give up.
+			r.ReadString('\n')
+			return false
+		}
+		if reply == disconnect {
+			return false
+		}
+		_, err := conn.Write([]byte(reply + "\r\n"))
+		return err == nil
+	}
+
+	if !write(s.replyTo(greeting, "220 localhost ESMTP")) {
+		return
+	}
+	// data contains the chunks received with BDAT.
+	var data []byte
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.cmds = append(s.cmds, cmd)
+		s.mu.Unlock()
+
+		verb := strings.ToUpper(cmd)
+		if i := strings.IndexByte(verb, ' '); i != -1 {
+			verb = verb[:i]
+		}
+
+		switch verb {
+		case "EHLO":
+			lines := append([]string{"localhost"}, s.ext...)
+			if s.tls != nil && !secure && !s.stripStartTLS {
+				lines = append(lines, "STARTTLS")
+			}
+			reply := ""
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					reply += "250 " + l
+				} else {
+					reply += "250-" + l + "\r\n"
+				}
+			}
+			if !write(s.replyTo(cmd, reply)) {
+				return
+			}
+		case "DATA":
+			reply := s.replyTo(cmd, "354 Go ahead")
+			if !write(reply) {
+				return
+			}
+			if !strings.HasPrefix(reply, "354") {
+				continue
+			}
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.receive(msg.String())
+			if !write(s.replyTo(".", "250 OK")) {
+				return
+			}
+		case "BDAT":
+			fields := strings.Fields(cmd)
+			size, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+			if !write(s.replyTo(cmd, "250 OK")) {
+				return
+			}
+			if len(fields) > 2 && fields[2] == "LAST" {
+				s.receive(string(data))
+				data = nil
+			}
+		case "RSET":
+			data = nil
+			if !write(s.replyTo(cmd, "250 OK")) {
+				return
+			}
+		case "STARTTLS":
+			if s.tls == nil || secure {
+				if !write(s.replyTo(cmd, "502 Not implemented")) {
+					return
+				}
+				continue
+			}
+			if !write(s.replyTo(cmd, "220 Ready to start TLS")) {
+				return
+			}
+			conn = tls.Server(conn, s.tls)
+			r = bufio.NewReader(conn)
+			secure = true
+		case "QUIT":
+			write(s.replyTo(cmd, "221 Bye"))
+			return
+		default:
+			if !write(s.replyTo(cmd, "250 OK")) {
+				return
+			}
+		}
+	}
+}
+
+func (s *fakeServer) replyTo(cmd, def string) string {
+	if s.reply != nil {
+		if reply := s.reply(cmd); reply != "" {
+			return reply
+		}
+	}
+	return def
+}
@@ -1,7 +1,9 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/hacku7/gomail/auth"
 	"github.com/hacku7/gomail/msg"
@@ -9,7 +11,9 @@ import (
 	"io"
 	"net"
 	"net/smtp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,18 +28,92 @@ type Dialer struct {
 	// Password is the password to use to authenticate to the SMTP server.
 	Password string
 	// Auth represents the authentication mechanism used to authenticate to the
-	// SMTP server.
+	// SMTP server. By default, the mechanism is chosen for each connection
+	// among AuthMechanisms. If it is set, it is shared by all the connections.
 	Auth smtp.Auth
+	// AuthMechanisms lists the authentication mechanisms that may be used when
+	// Auth is not set, from the most to the least preferred. The first one
+	// advertised by the SMTP server and usable with the credentials of the
+	// Dialer is used. By default, DefaultAuthMechanisms is used.
+	AuthMechanisms []string
+	// DisablePlaintextAuth prevents the PLAIN and LOGIN mechanisms, which send
+	// the password in clear, from being used on an unencrypted connection,
+	// including by Auth. ErrNoAuthMechanism is then returned.
+	DisablePlaintextAuth bool
+	// TokenSource returns the OAuth 2.0 access tokens used to authenticate
+	// Username to the SMTP server. When it is set, the OAUTHBEARER or XOAUTH2
+	// mechanism is used if the server supports it. Use auth.ReuseTokenSource
+	// to refresh the tokens before they expire.
+	TokenSource auth.TokenSource
 	// SSL defines whether an SSL connection is used. It should be false in
 	// most cases since the authentication mechanism should use the STARTTLS
-	// extension instead.
+	// extension instead. If it is true, TLSPolicy is ignored and TLSImplicit
+	// is used.
 	SSL bool
+	// TLSPolicy defines how TLS is used. By default, TLSOpportunistic is used.
+	// Use ParseTLSPolicy to read it from a configuration file.
+	TLSPolicy TLSPolicy
 	// TSLConfig represents the TLS configuration used for the TLS (when the
 	// STARTTLS extension is used) or SSL connection.
 	TLSConfig *tls.Config
 	// LocalName is the hostname sent to the SMTP server with the HELO command.
 	// By default, "localhost" is sent.
 	LocalName string
+	// Timeout is the maximum amount of time to wait for the TCP connection to
+	// the SMTP server to be established. By default, 10 seconds.
+	Timeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for the TLS
+	// handshake, when SSL is used or when the STARTTLS extension is used. By
+	// default, there is no timeout.
+	TLSHandshakeTimeout time.Duration
+	// CommandTimeout is the maximum amount of time to wait for the reply to an
+	// SMTP command. By default, there is no timeout.
+	CommandTimeout time.Duration
+	// DataTimeout is the maximum amount of time to send the content of an
+	// email and to wait for the reply of the SMTP server. By default, there is
+	// no timeout.
+	DataTimeout time.Duration
+	// SkipRejectedRecipients makes Send continue when the SMTP server rejects
+	// a recipient and send the email to the accepted ones. Send then returns a
+	// *RejectedRecipientsError listing the rejected recipients. By default,
+	// Send fails as soon as a recipient is rejected.
+	SkipRejectedRecipients bool
+	// MaxRecipients is the maximum number of recipients of an SMTP
+	// transaction. An email with more recipients is sent in several
+	// transactions. By default, there is no limit but the recipients rejected
+	// with a 452 reply because the limit of the server is reached are still
+	// sent in another transaction.
+	MaxRecipients int
+	// CheckSize makes Send compute the size of each email before sending it
+	// when the SMTP server advertises a maximum size with the SIZE extension.
+	// A larger email is not sent and Send returns a *SizeError. The WriteTo
+	// method of the email is then called twice, which reads the attached files
+	// twice and fails with the emails whose content can only be written once.
+	// By default, the size is not checked and the server rejects too large
+	// emails once it has received them.
+	CheckSize bool
+	// BinaryMIME makes the attachments and embedded files use the binary
+	// transfer encoding instead of base64 when the SMTP server supports the
+	// BINARYMIME and CHUNKING extensions, which makes large emails about 25%
+	// smaller. It only applies to the emails having a WriteBinaryTo method,
+	// like *msg.Message and *msg.Snapshot.
+	BinaryMIME bool
+	// DSN contains the Delivery Status Notification options sent with every
+	// email when the SMTP server supports the DSN extension. It can be
+	// overridden for an email with WithDSN.
+	DSN *DSN
+	// Retry is the policy used to retry sending an email after a transient
+	// failure, such as a 4xx reply, a timeout or a broken connection. The
+	// SMTP session is reset, or the connection is reopened if it is broken,
+	// between the attempts. An email is not sent again when the connection is
+	// broken once its content was sent, since the server may have received
+	// it. By default, sending an email is only retried once right away if the
+	// connection was closed by the server before the email was sent.
+	Retry *send.RetryPolicy
+
+	// ip is the address of Host to connect to. It is set by MXSender, which
+	// resolves Host itself to try each of its addresses.
+	ip string
 }
 
 // NewDialer returns a new SMTP Dialer. The given parameters are used to connect
@@ -61,60 +139,129 @@ func NewPlainDialer(host string, port int, username, password string) *Dialer {
 // Dial dials and authenticates to an SMTP server. The returned SendCloser
 // should be closed when done using it.
 func (d *Dialer) Dial() (send.SendCloser, error) {
-	conn, err := netDialTimeout("tcp", addr(d.Host, d.Port), 10*time.Second)
+	return d.DialContext(context.Background())
+}
+
+// DialContext dials and authenticates to an SMTP server. ctx bounds the
+// connection, the TLS handshake and the authentication, but not the use of the
+// returned SendCloser. The returned SendCloser should be closed when done
+// using it.
+func (d *Dialer) DialContext(ctx context.Context) (send.SendCloser, error) {
+	s, err := d.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return s, nil
+}
+
+func (d *Dialer) dial(ctx context.Context) (*smtpSender, error) {
+	s, a, err := d.connect(ctx)
+	if r, ok := a.(retrier); ok && err != nil && r.Retry() {
+		// The connection is closed after a failed authentication so a new one
+		// is needed.
+		s, _, err = d.connect(ctx)
+	}
+	return s, err
+}
+
+// connect opens a connection to the SMTP server. It also returns the
+// authentication mechanism used, if any, even when the authentication fails.
+func (d *Dialer) connect(ctx context.Context) (*smtpSender, smtp.Auth, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := addr(d.Host, d.Port)
+	if d.ip != "" {
+		address = net.JoinHostPort(d.ip, strconv.Itoa(d.Port))
+	}
+	conn, err := netDialContext(dialCtx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if d.SSL {
-		conn = tlsClient(conn, d.tlsConfig())
+	s := &smtpSender{d: d, conn: conn}
+	stop := s.watch(ctx)
+	defer stop()
+
+	c, a, err := s.handshake(d)
+	if err != nil {
+		conn.Close()
+		return nil, a, contextError(ctx, err)
 	}
+	s.smtpClient = c
+
+	return s, a, nil
+}
 
+func (s *smtpSender) handshake(d *Dialer) (smtpClient, smtp.Auth, error) {
+	policy := d.tlsPolicy()
+	if policy < TLSOpportunistic || policy > TLSImplicit {
+		return nil, nil, fmt.Errorf("gomail: invalid TLS policy %v", policy)
+	}
+
+	conn := s.conn
+	if policy == TLSImplicit {
+		tc := tlsClient(conn, d.tlsConfig())
+		if err := s.setTimeout(d.TLSHandshakeTimeout); err != nil {
+			return nil, nil, err
+		}
+		if err := tlsHandshake(s.ctx, tc); err != nil {
+			return nil, nil, err
+		}
+		conn = tc
+	}
+
+	if err := s.setTimeout(d.CommandTimeout); err != nil {
+		return nil, nil, err
+	}
 	c, err := smtpNewClient(conn, d.Host)
 	if err != nil {
-		return nil, err
+		return nil, nil, wrapError("CONNECT", "", err)
 	}
 
 	if d.LocalName != "" {
 		if err := c.Hello(d.LocalName); err != nil {
-			return nil, err
+			return nil, nil, wrapError("EHLO", "", err)
 		}
 	}
 
-	if !d.SSL {
-		if ok, _ := c.Extension("STARTTLS"); ok {
+	if policy == TLSOpportunistic || policy == TLSMandatory {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && policy == TLSMandatory {
+			c.Close()
+			return nil, nil, ErrStartTLSNotSupported
+		}
+		if ok {
+			if err := s.setTimeout(d.TLSHandshakeTimeout); err != nil {
+				return nil, nil, err
+			}
 			if err := c.StartTLS(d.tlsConfig()); err != nil {
 				c.Close()
-				return nil, err
+				return nil, nil, wrapError("STARTTLS", "", err)
 			}
 		}
 	}
 
-	if d.Auth == nil && d.Username != "" {
-		if ok, auths := c.Extension("AUTH"); ok {
-			if strings.Contains(auths, "CRAM-MD5") {
-				d.Auth = smtp.CRAMMD5Auth(d.Username, d.Password)
-			} else if strings.Contains(auths, "LOGIN") &&
-				!strings.Contains(auths, "PLAIN") {
-				d.Auth = &auth.LoginAuth{
-					Username: d.Username,
-					Password: d.Password,
-					Host:     d.Host,
-				}
-			} else {
-				d.Auth = smtp.PlainAuth("", d.Username, d.Password, d.Host)
-			}
-		}
+	a, err := d.auth(c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
 	}
-
-	if d.Auth != nil {
-		if err = c.Auth(d.Auth); err != nil {
+	if a != nil {
+		if err := s.setTimeout(d.CommandTimeout); err != nil {
+			return nil, a, err
+		}
+		if err := c.Auth(a); err != nil {
 			c.Close()
-			return nil, err
+			return nil, a, wrapError("AUTH", "", err)
 		}
 	}
 
-	return &smtpSender{c, d}, nil
+	return c, a, nil
 }
 
 func (d *Dialer) tlsConfig() *tls.Config {
@@ -131,64 +278,628 @@ func addr(host string, port int) string {
 // DialAndSend opens a connection to the SMTP server, sends the given emails and
 // closes the connection.
 func (d *Dialer) DialAndSend(m ...*msg.Message) error {
-	s, err := d.Dial()
+	return d.DialAndSendContext(context.Background(), m...)
+}
+
+// DialAndSendContext opens a connection to the SMTP server, sends the given
+// emails and closes the connection. ctx bounds the whole operation.
+func (d *Dialer) DialAndSendContext(ctx context.Context, m ...*msg.Message) error {
+	s, err := d.DialContext(ctx)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	return send.Send(s, m...)
+	return send.SendContext(ctx, s, m...)
 }
 
 type smtpSender struct {
 	smtpClient
-	d *Dialer
+	d    *Dialer
+	conn net.Conn
+	// broken is set when the connection was closed after a failure. It is
+	// reopened before sending the next email.
+	broken bool
+	// dataSent is set once the whole content of the email was sent. The
+	// server may then have received the email even if its reply is missing.
+	dataSent bool
+
+	// mu guards ctx and the deadline of conn.
+	mu  sync.Mutex
+	ctx context.Context
 }
 
 func (c *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
-	if err := c.Mail(from); err != nil {
-		if err == io.EOF {
-			// This is probably due to a timeout, so reconnect and try again.
-			sc, derr := c.d.Dial()
-			if derr == nil {
-				if s, ok := sc.(*smtpSender); ok {
-					*c = *s
-					return c.Send(from, to, msg)
-				}
-			}
+	return c.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext implements send.ContextSender.
+func (c *smtpSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	return resultError(c.SendResult(ctx, from, to, msg))
+}
+
+// SendResult implements ResultSender.
+func (c *smtpSender) SendResult(ctx context.Context, from string, to []string, msg io.WriterTo) (*Result, error) {
+	return c.SendEnvelopeResult(ctx, &send.Envelope{From: from, To: to}, msg)
+}
+
+// SendEnvelope implements send.EnvelopeSender.
+func (c *smtpSender) SendEnvelope(ctx context.Context, env *send.Envelope, msg io.WriterTo) error {
+	return resultError(c.SendEnvelopeResult(ctx, env, msg))
+}
+
+// SendEnvelopeResult implements ResultSender.
+func (c *smtpSender) SendEnvelopeResult(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, error) {
+	res, _, err := c.sendEnvelope(ctx, env, msg)
+	return res, err
+}
+
+// sendEnvelope is like SendEnvelopeResult but also reports whether the email
+// was sent to some recipients, in an earlier transaction, when the
+// recipients are split into several transactions and one of them fails.
+func (c *smtpSender) sendEnvelope(ctx context.Context, env *send.Envelope, msg io.WriterTo) (res *Result, sent bool, err error) {
+	to := env.To
+	for {
+		e := *env
+		e.To, to = c.d.splitRecipients(to)
+		r, deferred, err := c.transaction(ctx, &e, msg)
+		res = res.add(r)
+		if _, ok := err.(*RejectedRecipientsError); err != nil && !ok {
+			return res, sent, err
+		}
+		sent = sent || err == nil
+
+		// The deferred recipients are sent first since they were supposed to
+		// be sent in this transaction.
+		to = append(append([]string(nil), deferred...), to...)
+		if len(to) == 0 {
+			break
 		}
+	}
+
+	if len(res.Accepted) == 0 && len(res.Rejected) > 0 {
+		return res, sent, &RejectedRecipientsError{Result: res}
+	}
+	return res, sent, nil
+}
+
+// splitRecipients returns the recipients of the next transaction and the
+// remaining ones.
+func (d *Dialer) splitRecipients(to []string) (next, rest []string) {
+	if d.MaxRecipients <= 0 || len(to) <= d.MaxRecipients {
+		return to, nil
+	}
+	return to[:d.MaxRecipients], to[d.MaxRecipients:]
+}
+
+// transaction sends an email in one SMTP transaction and retries it according
+// to the policy of the Dialer. It also returns the recipients which could not
+// be added to the transaction because the server limit was reached.
+func (c *smtpSender) transaction(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, []string, error) {
+	if c.d.Retry == nil {
+		res, deferred, err := c.sendResult(ctx, env, msg)
+		c.recover(err)
+		return res, deferred, err
+	}
+
+	p := *c.d.Retry
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = send.IsTemporary
+	}
+	p.Retryable = func(err error) bool {
+		// Without a reply, the server may have received the email once its
+		// content was sent, so it is not sent again.
+		var serr *Error
+		if c.dataSent && !errors.As(err, &serr) {
+			return false
+		}
+		return retryable(err)
+	}
+
+	var res *Result
+	var deferred []string
+	err := p.Do(ctx, func() error {
+		var err error
+		res, deferred, err = c.sendResult(ctx, env, msg)
+		c.recover(err)
 		return err
+	})
+	return res, deferred, err
+}
+
+// recover makes the connection usable by the next email after a failure. The
+// SMTP session is reset if the server rejected a command. Otherwise, the state
+// of the session is unknown so the connection is closed and it is reopened
+// before sending the next email.
+func (c *smtpSender) recover(err error) {
+	if c.broken {
+		return
+	}
+	switch err.(type) {
+	case nil, *RejectedRecipientsError, *SizeError:
+		return
+	case *Error:
+		if c.reset() == nil {
+			return
+		}
+	}
+	c.broken = true
+	c.conn.Close()
+}
+
+func (c *smtpSender) sendResult(ctx context.Context, env *send.Envelope, msg io.WriterTo) (*Result, []string, error) {
+	c.dataSent = false
+	if c.broken {
+		s, err := c.d.dial(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.replace(s)
+	}
+
+	dsn := c.d.dsn(ctx)
+	stop := c.watch(ctx)
+	res, deferred, err := c.send(env, msg, dsn)
+	stop()
+
+	if err == errClosed {
+		// This is probably due to a timeout, so reconnect and try again.
+		s, derr := c.d.dial(ctx)
+		if derr != nil {
+			return nil, nil, io.EOF
+		}
+		c.replace(s)
+
+		stop := c.watch(ctx)
+		res, deferred, err = c.send(env, msg, dsn)
+		stop()
+	}
+	if err == errClosed {
+		err = io.EOF
+	}
+
+	return res, deferred, contextError(ctx, err)
+}
+
+// errClosed is returned by send when the server closed the connection before
+// replying to the MAIL command. Nothing was sent, so the email can be sent
+// again with a new connection.
+var errClosed = errors.New("gomail: connection closed before MAIL")
+
+// replace closes the connection and uses the one of s instead.
+func (c *smtpSender) replace(s *smtpSender) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Close()
+	c.smtpClient = s.smtpClient
+	c.conn = s.conn
+	c.broken = false
+}
+
+func (c *smtpSender) send(env *send.Envelope, msg io.WriterTo, dsn *DSN) (res *Result, deferred []string, err error) {
+	if ok, _ := c.Extension("DSN"); !ok {
+		dsn = nil
+	} else if err := dsn.validate(); err != nil {
+		return nil, nil, err
+	}
+	chunking, _ := c.Extension("CHUNKING")
+	binary := false
+	if b, ok := msg.(binaryWriterTo); ok && chunking && c.d.BinaryMIME {
+		if binary, _ = c.Extension("BINARYMIME"); binary {
+			msg = writerToFunc(b.WriteBinaryTo)
+		}
+	}
+	size, err := c.checkSize(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	mail, err := c.mailCommand(env, binary, size, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		return c.sendPipelined(mail, env, msg, dsn, chunking)
+	}
+
+	if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.Cmd(25, "%s", mail); err == io.EOF {
+		return nil, nil, errClosed
+	} else if err != nil {
+		return nil, nil, wrapError("MAIL", "", err)
+	}
+
+	res = new(Result)
+	for i, addr := range env.To {
+		if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+			return res, nil, err
+		}
+		code, text, err := c.rcpt(env, addr, dsn)
+		if serr, ok := err.(*Error); ok && serr.Code == 452 && len(res.Accepted) > 0 {
+			// The server limit of recipients is reached, the other recipients
+			// are sent in another transaction.
+			deferred = env.To[i:]
+			break
+		} else if ok && c.d.SkipRejectedRecipients {
+			res.Rejected = append(res.Rejected, RecipientResult{
+				Address:      addr,
+				Code:         serr.Code,
+				EnhancedCode: serr.EnhancedCode,
+				Message:      serr.Message,
+			})
+			continue
+		} else if err != nil {
+			return res, nil, err
+		}
+		res.Accepted = append(res.Accepted, recipientResult(addr, code, text))
 	}
 
-	for _, addr := range to {
-		if err := c.Rcpt(addr); err != nil {
-			return err
+	if len(res.Accepted) == 0 && len(res.Rejected) > 0 {
+		// End the transaction so that the connection can be reused.
+		if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+			return res, nil, err
 		}
+		if err := c.Reset(); err != nil {
+			return res, nil, wrapError("RSET", "", err)
+		}
+		return res, nil, &RejectedRecipientsError{Result: res}
 	}
 
+	if chunking {
+		return res, deferred, c.writeData("BDAT", c.ChunkWriter(), msg)
+	}
+	if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+		return res, nil, err
+	}
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return res, nil, wrapError("DATA", "", err)
 	}
+	return res, deferred, c.writeData("DATA", w, msg)
+}
 
-	if _, err = msg.WriteTo(w); err != nil {
-		w.Close()
+// writeData writes the content of the email to w and closes it. The errors
+// are reported as errors of the given command.
+func (c *smtpSender) writeData(command string, w io.WriteCloser, msg io.WriterTo) error {
+	// The writer is not closed on failure, since it would end the content of
+	// the email and the server would send the partial email.
+	if err := c.setTimeout(c.d.DataTimeout); err != nil {
 		return err
 	}
+	if _, err := msg.WriteTo(w); err != nil {
+		return wrapError(command, "", err)
+	}
+	c.dataSent = true
+	return wrapError(command, "", w.Close())
+}
+
+// A binaryWriterTo is an email that can be written with the binary transfer
+// encoding, like *msg.Message.
+type binaryWriterTo interface {
+	WriteBinaryTo(w io.Writer) (int64, error)
+}
+
+// writerToFunc is an adapter to use a function as an io.WriterTo.
+type writerToFunc func(w io.Writer) (int64, error)
+
+func (f writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return f(w)
+}
+
+// sendPipelined sends the MAIL, RCPT and DATA commands at once and then
+// checks their replies, which saves a round trip per recipient. DATA is not
+// sent when the content is sent with BDAT.
+func (c *smtpSender) sendPipelined(mail string, env *send.Envelope, msg io.WriterTo, dsn *DSN, chunking bool) (res *Result, deferred []string, err error) {
+	cmds := []string{mail}
+	for _, addr := range env.To {
+		rcpt, err := rcptCommand(env, addr, dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, rcpt)
+	}
+	if !chunking {
+		cmds = append(cmds, "DATA")
+	}
 
-	return w.Close()
+	if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+		return nil, nil, err
+	}
+	replies, err := c.Pipeline(cmds...)
+	if err == io.EOF {
+		// The content was not sent, so the email was not accepted.
+		return nil, nil, errClosed
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var rerr error
+	if r := replies[0]; r.code/100 != 2 {
+		rerr = r.err("MAIL", "")
+	}
+	accepted := false
+	for _, r := range replies[1 : len(env.To)+1] {
+		accepted = accepted || r.code/10 == 25
+	}
+	res = new(Result)
+	for i, addr := range env.To {
+		r := replies[i+1]
+		if r.code/10 == 25 {
+			res.Accepted = append(res.Accepted, recipientResult(addr, r.code, r.msg))
+			continue
+		}
+		if r.code == 452 && accepted {
+			// The server limit of recipients is reached, the recipient is
+			// sent in another transaction.
+			deferred = append(deferred, addr)
+			continue
+		}
+		serr := r.err("RCPT", addr)
+		res.Rejected = append(res.Rejected, RecipientResult{
+			Address:      addr,
+			Code:         serr.Code,
+			EnhancedCode: serr.EnhancedCode,
+			Message:      serr.Message,
+		})
+		if rerr == nil && !c.d.SkipRejectedRecipients {
+			rerr = serr
+		}
+	}
+	if rerr == nil && len(res.Accepted) == 0 && len(res.Rejected) > 0 {
+		rerr = &RejectedRecipientsError{Result: res}
+	}
+
+	if !chunking {
+		switch data := replies[len(replies)-1]; {
+		case rerr != nil && data.code == 354:
+			// The content of the email cannot be aborted once DATA is
+			// accepted, so the connection is closed instead.
+			c.broken = true
+			c.conn.Close()
+			return res, nil, rerr
+		case rerr == nil && data.code != 354:
+			return res, nil, data.err("DATA", "")
+		}
+	}
+	if rerr != nil {
+		if _, ok := rerr.(*RejectedRecipientsError); ok {
+			if err := c.reset(); err != nil {
+				return res, nil, wrapError("RSET", "", err)
+			}
+		}
+		return res, nil, rerr
+	}
+
+	if chunking {
+		return res, deferred, c.writeData("BDAT", c.ChunkWriter(), msg)
+	}
+	return res, deferred, c.writeData("DATA", c.DataWriter(), msg)
+}
+
+// checkSize returns the size of the email if Dialer.CheckSize is set and the
+// server advertises a maximum size with the SIZE extension defined in RFC
+// 1870, or -1 otherwise. It returns a *SizeError if the email exceeds the
+// maximum size.
+func (c *smtpSender) checkSize(msg io.WriterTo) (int64, error) {
+	if !c.d.CheckSize {
+		return -1, nil
+	}
+	ok, param := c.Extension("SIZE")
+	if !ok {
+		return -1, nil
+	}
+	limit, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || limit <= 0 {
+		return -1, nil
+	}
+
+	// The email is written twice but it avoids uploading an email that would
+	// be rejected anyway. The bytes are counted since the value returned by
+	// WriteTo may not include the whole body.
+	var w countWriter
+	if _, err := msg.WriteTo(&w); err != nil {
+		return 0, err
+	}
+	size := int64(w)
+	if size > limit {
+		return size, &SizeError{Size: size, Limit: limit}
+	}
+	return size, nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
+// mailCommand returns the MAIL command, with the same parameters as the one
+// sent by smtp.Client.Mail. The BODY parameter is set to BINARYMIME if binary
+// is true, the SIZE parameter is set if size is not negative and the DSN
+// parameters are set if dsn is not nil. The parameters of env are added last.
+func (c *smtpSender) mailCommand(env *send.Envelope, binary bool, size int64, dsn *DSN) (string, error) {
+	if err := validateLine(env.From); err != nil {
+		return "", err
+	}
+	cmd := "MAIL FROM:<" + env.From + ">"
+	if binary {
+		cmd += " BODY=BINARYMIME"
+	} else if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	if size >= 0 {
+		cmd += " SIZE=" + strconv.FormatInt(size, 10)
+	}
+	return withParams(cmd+dsn.mailParams(), env.MailParams)
+}
+
+// rcptCommand returns the RCPT command of the given recipient, with its DSN
+// parameters if dsn is not nil and its parameters in env.
+func rcptCommand(env *send.Envelope, addr string, dsn *DSN) (string, error) {
+	if err := validateLine(addr); err != nil {
+		return "", err
+	}
+	return withParams("RCPT TO:<"+addr+">"+dsn.rcptParams(addr), env.RcptParams[addr])
+}
+
+// withParams adds the given parameters to a command.
+func withParams(cmd string, params []string) (string, error) {
+	for _, p := range params {
+		if err := validateLine(p); err != nil {
+			return "", err
+		}
+		cmd += " " + p
+	}
+	return cmd, nil
+}
+
+func (c *smtpSender) rcpt(env *send.Envelope, addr string, dsn *DSN) (int, string, error) {
+	cmd, err := rcptCommand(env, addr, dsn)
+	if err != nil {
+		return 0, "", err
+	}
+	code, text, err := c.Cmd(25, "%s", cmd)
+	return code, text, wrapError("RCPT", addr, err)
+}
+
+// validateLine checks that a line does not contain CR or LF, which could be
+// used to inject SMTP commands.
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("gomail: a line must not contain CR or LF")
+	}
+	return nil
+}
+
+// noop checks that the connection is still alive.
+func (c *smtpSender) noop() error {
+	return c.command(c.Noop)
+}
+
+// reset aborts the current SMTP transaction.
+func (c *smtpSender) reset() error {
+	return c.command(c.Reset)
+}
+
+// command runs an SMTP command outside of a transaction, bounded by the
+// command timeout.
+func (c *smtpSender) command(cmd func() error) error {
+	if err := c.setTimeout(c.d.CommandTimeout); err != nil {
+		return err
+	}
+	err := cmd()
+	c.conn.SetDeadline(time.Time{})
+	return err
 }
 
 func (c *smtpSender) Close() error {
+	if c.broken {
+		// The connection is already closed.
+		return nil
+	}
+	c.setTimeout(c.d.CommandTimeout)
 	return c.Quit()
 }
 
+// watch makes the operations on the connection bounded by ctx until stop is
+// called.
+func (c *smtpSender) watch(ctx context.Context) (stop func()) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.mu.Lock()
+				// Unblock the pending reads and writes right away.
+				c.conn.SetDeadline(time.Unix(1, 0))
+				c.mu.Unlock()
+			case <-done:
+			}
+		}()
+	}
+
+	return func() {
+		close(done)
+		c.mu.Lock()
+		c.ctx = nil
+		c.conn.SetDeadline(time.Time{})
+		c.mu.Unlock()
+	}
+}
+
+// setTimeout sets the deadline of the connection to the given timeout, or to
+// the deadline of the current context if it is sooner. A zero timeout means no
+// timeout.
+func (c *smtpSender) setTimeout(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if deadline, ok := ctx.Deadline(); ok && (t.IsZero() || deadline.Before(t)) {
+		t = deadline
+	}
+	c.conn.SetDeadline(t)
+	return nil
+}
+
+// contextError returns the error of ctx if it is done, since err is then only
+// a consequence of ctx being done.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadlineReached(ctx) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// deadlineReached reports whether the deadline of ctx is reached. The
+// connection deadline may be reached slightly before ctx is done.
+func deadlineReached(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
 // Stubbed out for tests.
 var (
-	netDialTimeout = net.DialTimeout
+	netDialContext = (&net.Dialer{}).DialContext
 	tlsClient      = tls.Client
-	smtpNewClient  = func(conn net.Conn, host string) (smtpClient, error) {
-		return smtp.NewClient(conn, host)
+	tlsHandshake   = func(ctx context.Context, conn *tls.Conn) error {
+		return conn.HandshakeContext(ctx)
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			return nil, err
+		}
+		return &client{c}, nil
 	}
 )
 
@@ -197,9 +908,14 @@ type smtpClient interface {
 	Extension(string) (bool, string)
 	StartTLS(*tls.Config) error
 	Auth(smtp.Auth) error
-	Mail(string) error
-	Rcpt(string) error
+	Cmd(expectCode int, format string, args ...interface{}) (int, string, error)
+	Pipeline(cmds ...string) ([]reply, error)
 	Data() (io.WriteCloser, error)
+	DataWriter() io.WriteCloser
+	ChunkWriter() io.WriteCloser
+	Noop() error
+	Reset() error
+	TLSConnectionState() (tls.ConnectionState, bool)
 	Quit() error
 	Close() error
 }
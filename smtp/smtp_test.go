@@ -2,12 +2,20 @@ package smtp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/hacku7/gomail/auth"
 	"github.com/hacku7/gomail/msg"
+	"github.com/hacku7/gomail/send"
 	"io"
 	"net"
 	"net/smtp"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,7 +32,7 @@ const (
 	testBody    = "Test msg"
 	testMsg     = "To: " + testTo1 + ", " + testTo2 + "\r\n" +
 		"From: " + testFrom + "\r\n" +
-		"Mime-Version: 1.0\r\n" +
+		"MIME-Version: 1.0\r\n" +
 		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
 		"Content-Type: text/plain; charset=UTF-8\r\n" +
 		"Content-Transfer-Encoding: quoted-printable\r\n" +
@@ -32,6 +40,12 @@ const (
 		testBody
 )
 
+func init() {
+	msg.Now = func() time.Time {
+		return time.Date(2014, 06, 25, 17, 46, 0, 0, time.UTC)
+	}
+}
+
 var (
 	testConn    = &net.TCPConn{}
 	testTLSConn = &tls.Conn{}
@@ -46,9 +60,9 @@ func TestDialer(t *testing.T) {
 		"StartTLS",
 		"Extension AUTH",
 		"Auth",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -62,9 +76,9 @@ func TestDialerSSL(t *testing.T) {
 	testSendMail(t, d, []string{
 		"Extension AUTH",
 		"Auth",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -83,9 +97,9 @@ func TestDialerConfig(t *testing.T) {
 		"StartTLS",
 		"Extension AUTH",
 		"Auth",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -102,9 +116,9 @@ func TestDialerSSLConfig(t *testing.T) {
 		"Hello test",
 		"Extension AUTH",
 		"Auth",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -121,9 +135,9 @@ func TestDialerNoAuth(t *testing.T) {
 	testSendMail(t, d, []string{
 		"Extension STARTTLS",
 		"StartTLS",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -140,12 +154,12 @@ func TestDialerTimeout(t *testing.T) {
 	testSendMailTimeout(t, d, []string{
 		"Extension STARTTLS",
 		"StartTLS",
-		"Mail " + testFrom,
+		"MAIL FROM:<" + testFrom + ">",
 		"Extension STARTTLS",
 		"StartTLS",
-		"Mail " + testFrom,
-		"Rcpt " + testTo1,
-		"Rcpt " + testTo2,
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
 		"Data",
 		"Write msg",
 		"Close writer",
@@ -169,8 +183,13 @@ func (c *mockClient) Hello(localName string) error {
 }
 
 func (c *mockClient) Extension(ext string) (bool, string) {
-	c.do("Extension " + ext)
-	return true, ""
+	switch ext {
+	case "STARTTLS", "AUTH":
+		c.do("Extension " + ext)
+		return true, ""
+	}
+	// The other extensions are tested with the fake server.
+	return false, ""
 }
 
 func (c *mockClient) StartTLS(config *tls.Config) error {
@@ -187,17 +206,28 @@ func (c *mockClient) Auth(a smtp.Auth) error {
 	return nil
 }
 
-func (c *mockClient) Mail(from string) error {
-	c.do("Mail " + from)
-	if c.timeout {
+func (c *mockClient) Cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	cmd := fmt.Sprintf(format, args...)
+	c.do(cmd)
+	if c.timeout && strings.HasPrefix(cmd, "MAIL") {
 		c.timeout = false
-		return io.EOF
+		return 0, "", io.EOF
 	}
+	return 250, "OK", nil
+}
+
+func (c *mockClient) Pipeline(cmds ...string) ([]reply, error) {
+	c.t.Fatal("Pipeline should not be used without the PIPELINING extension")
+	return nil, nil
+}
+
+func (c *mockClient) DataWriter() io.WriteCloser {
+	c.t.Fatal("DataWriter should not be used without the PIPELINING extension")
 	return nil
 }
 
-func (c *mockClient) Rcpt(to string) error {
-	c.do("Rcpt " + to)
+func (c *mockClient) ChunkWriter() io.WriteCloser {
+	c.t.Fatal("ChunkWriter should not be used without the CHUNKING extension")
 	return nil
 }
 
@@ -206,6 +236,20 @@ func (c *mockClient) Data() (io.WriteCloser, error) {
 	return &mockWriter{c: c, want: testMsg}, nil
 }
 
+func (c *mockClient) Noop() error {
+	c.do("Noop")
+	return nil
+}
+
+func (c *mockClient) Reset() error {
+	c.do("Reset")
+	return nil
+}
+
+func (c *mockClient) TLSConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, false
+}
+
 func (c *mockClient) Quit() error {
 	c.do("Quit")
 	return nil
@@ -264,7 +308,7 @@ func doTestSendMail(t *testing.T, d *Dialer, want []string, timeout bool) {
 		timeout: timeout,
 	}
 
-	netDialTimeout = func(network, address string, d time.Duration) (net.Conn, error) {
+	netDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
 		if network != "tcp" {
 			t.Errorf("Invalid network, got %q, want tcp", network)
 		}
@@ -283,6 +327,13 @@ func doTestSendMail(t *testing.T, d *Dialer, want []string, timeout bool) {
 		return testTLSConn
 	}
 
+	tlsHandshake = func(ctx context.Context, conn *tls.Conn) error {
+		if conn != testTLSConn {
+			t.Errorf("Invalid conn, got %#v, want %#v", conn, testTLSConn)
+		}
+		return nil
+	}
+
 	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
 		if host != TestHost {
 			t.Errorf("Invalid host, got %q, want %q", host, TestHost)
@@ -315,3 +366,480 @@ func assertConfig(t *testing.T, got, want *tls.Config) {
 		t.Errorf("Invalid field InsecureSkipVerify in config, got %v, want %v", got.InsecureSkipVerify, want.InsecureSkipVerify)
 	}
 }
+
+func TestDialerFakeServer(t *testing.T) {
+	s := newFakeServer(t)
+	d := s.dialer()
+	d.TLSHandshakeTimeout = time.Second
+	d.CommandTimeout = time.Second
+	d.DataTimeout = time.Second
+
+	if err := d.DialAndSendContext(context.Background(), getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"EHLO localhost",
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
+		"DATA",
+		"QUIT",
+	}
+	if got := s.commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid commands, got %q, want %q", got, want)
+	}
+}
+
+func TestDialerCommandTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == greeting {
+			return hang
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.CommandTimeout = 50 * time.Millisecond
+
+	_, err := d.Dial()
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Dial() should time out, got %v", err)
+	}
+}
+
+func TestDialerContextCanceled(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == greeting {
+			return hang
+		}
+		return ""
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := s.dialer().DialContext(ctx); err != context.Canceled {
+		t.Errorf("DialContext() should be canceled, got %v", err)
+	}
+}
+
+func TestSendDataTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == "." {
+			return hang
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.CommandTimeout = time.Second
+	d.DataTimeout = 50 * time.Millisecond
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	err = sc.Send(testFrom, []string{testTo1}, getTestMessage())
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Send() should time out, got %v", err)
+	}
+}
+
+func TestSendContextDeadline(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			return hang
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.CommandTimeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := d.DialAndSendContext(ctx, getTestMessage())
+	if err == nil || !strings.HasSuffix(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("DialAndSendContext() should exceed its deadline, got %v", err)
+	}
+}
+
+func TestDialerOAuth(t *testing.T) {
+	tests := []struct {
+		mechanisms string
+		want       string
+	}{
+		{"PLAIN XOAUTH2 OAUTHBEARER", "OAUTHBEARER"},
+		{"PLAIN XOAUTH2", "XOAUTH2"},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, "AUTH "+test.mechanisms)
+		s.reply = func(cmd string) string {
+			if strings.HasPrefix(cmd, "AUTH") {
+				return "235 Accepted"
+			}
+			return ""
+		}
+		d := s.dialer()
+		d.Username = TestUser
+		d.TokenSource = auth.StaticTokenSource("token")
+
+		sc, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.Close()
+
+		if cmd := s.commands()[1]; !strings.HasPrefix(cmd, "AUTH "+test.want+" ") {
+			t.Errorf("Invalid command, got %q, want AUTH %s", cmd, test.want)
+		}
+	}
+}
+
+func TestDialerOAuthRetry(t *testing.T) {
+	s := newFakeServer(t, "AUTH XOAUTH2")
+	var mu sync.Mutex
+	auths := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(cmd, "AUTH"):
+			auths++
+			if auths == 1 {
+				return "334 " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`))
+			}
+			return "235 Accepted"
+		case cmd == "":
+			return "535 5.7.8 Invalid credentials"
+		}
+		return ""
+	}
+
+	tokens := 0
+	d := s.dialer()
+	d.Username = TestUser
+	d.TokenSource = auth.ReuseTokenSource(auth.TokenSourceFunc(func() (*auth.Token, error) {
+		tokens++
+		return &auth.Token{AccessToken: fmt.Sprintf("token%d", tokens)}, nil
+	}))
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+
+	if tokens != 2 {
+		t.Errorf("The rejected token should be refreshed, got %d tokens, want 2", tokens)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("Invalid number of connections, got %d, want 2", n)
+	}
+	resp := base64.StdEncoding.EncodeToString([]byte("user=" + TestUser + "\x01auth=Bearer token2\x01\x01"))
+	cmds := s.commands()
+	if got, want := cmds[len(cmds)-2], "AUTH XOAUTH2 "+resp; got != want {
+		t.Errorf("Invalid command, got %q, want %q", got, want)
+	}
+}
+
+func TestDialerScram(t *testing.T) {
+	tests := []struct {
+		mechanisms string
+		want       string
+	}{
+		{"PLAIN CRAM-MD5 SCRAM-SHA-1 SCRAM-SHA-256", "SCRAM-SHA-256"},
+		{"PLAIN SCRAM-SHA-256-PLUS SCRAM-SHA-1", "SCRAM-SHA-1"},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t, "AUTH "+test.mechanisms)
+		s.reply = func(cmd string) string {
+			if strings.HasPrefix(cmd, "AUTH") {
+				return "235 Accepted"
+			}
+			return ""
+		}
+		d := s.dialer()
+		d.Username = TestUser
+		d.Password = TestPwd
+
+		// The server does not send its signature so it must be rejected.
+		if _, err := d.Dial(); err == nil {
+			t.Error("Dial() should fail without the server signature")
+		}
+		if cmd := s.commands()[1]; !strings.HasPrefix(cmd, "AUTH "+test.want+" ") {
+			t.Errorf("Invalid command, got %q, want AUTH %s", cmd, test.want)
+		}
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	mails := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(cmd, "MAIL") {
+			mails++
+			if mails < 3 {
+				return "451 4.3.0 Try again later"
+			}
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.Retry = &send.RetryPolicy{MinBackoff: time.Millisecond}
+
+	if err := d.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"EHLO localhost",
+		"MAIL FROM:<" + testFrom + ">",
+		"RSET",
+		"MAIL FROM:<" + testFrom + ">",
+		"RSET",
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
+		"DATA",
+		"QUIT",
+	}
+	if got := s.commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid commands, got %q, want %q", got, want)
+	}
+}
+
+func TestSendRetryRedial(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	mails := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(cmd, "MAIL") {
+			mails++
+			if mails == 1 {
+				return hang
+			}
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.CommandTimeout = 50 * time.Millisecond
+	d.Retry = &send.RetryPolicy{MinBackoff: time.Millisecond}
+
+	if err := d.DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("The connection should be reopened after a timeout, got %d connections", n)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Errorf("The email should be sent once, got %d emails", n)
+	}
+}
+
+func TestSendClosedAfterData(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == "." {
+			return disconnect
+		}
+		return ""
+	}
+
+	if err := s.dialer().DialAndSend(getTestMessage()); !errors.Is(err, io.EOF) {
+		t.Errorf("Invalid error, got %v, want %v", err, io.EOF)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Errorf("The email should not be sent again once its content was sent, got %d emails", n)
+	}
+}
+
+func TestSendRetryClosedAfterData(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if cmd == "." {
+			return disconnect
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.Retry = &send.RetryPolicy{MinBackoff: time.Millisecond}
+
+	if err := d.DialAndSend(getTestMessage()); !errors.Is(err, io.EOF) {
+		t.Errorf("Invalid error, got %v, want %v", err, io.EOF)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Errorf("The email should not be sent again once its content was sent, got %d emails", n)
+	}
+}
+
+func TestSendClosedBeforeMail(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	mails := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(cmd, "MAIL") {
+			if mails++; mails == 1 {
+				return disconnect
+			}
+		}
+		return ""
+	}
+
+	if err := s.dialer().DialAndSend(getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("The connection should be reopened, got %d connections", n)
+	}
+}
+
+func TestSendRetryPermanentError(t *testing.T) {
+	s := newFakeServer(t)
+	s.reply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "MAIL") {
+			return "550 5.7.1 Sender rejected"
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.Retry = &send.RetryPolicy{MinBackoff: time.Millisecond}
+
+	if err := d.DialAndSend(getTestMessage()); err == nil {
+		t.Fatal("DialAndSend() should fail")
+	}
+	n := 0
+	for _, cmd := range s.commands() {
+		if strings.HasPrefix(cmd, "MAIL") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("A permanent error should not be retried, got %d attempts", n)
+	}
+}
+
+func TestSendRecoverAfterRejection(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	mails := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(cmd, "RCPT") {
+			mails++
+			if mails == 1 {
+				return "550 5.1.1 No such user"
+			}
+		}
+		return ""
+	}
+
+	sc, err := s.dialer().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if err := send.Send(sc, getTestMessage(), getTestMessage()); err == nil {
+		t.Error("The first email should fail")
+	}
+	if err := send.Send(sc, getTestMessage()); err != nil {
+		t.Errorf("The next email should be sent, got %v", err)
+	}
+
+	cmds := s.commands()
+	if cmds[3] != "RSET" {
+		t.Errorf("The transaction should be reset after the failure, got %q", cmds)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("The connection should be reused, got %d connections", n)
+	}
+}
+
+func TestSendRecoverBrokenConnection(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	ends := 0
+	s.reply = func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd == "." {
+			ends++
+			if ends == 1 {
+				return hang
+			}
+		}
+		return ""
+	}
+	d := s.dialer()
+	d.DataTimeout = 50 * time.Millisecond
+
+	sc, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if err := send.Send(sc, getTestMessage()); err == nil {
+		t.Error("The first email should time out")
+	}
+	if err := send.Send(sc, getTestMessage()); err != nil {
+		t.Errorf("The next email should be sent, got %v", err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("The connection should be reopened, got %d connections", n)
+	}
+}
+
+type failingWriterTo struct{}
+
+func (failingWriterTo) WriteTo(w io.Writer) (int64, error) {
+	n, _ := io.WriteString(w, "Subject: partial\r\n\r\n")
+	return int64(n), errors.New("gomail: could not open attachment")
+}
+
+func TestSendWriteError(t *testing.T) {
+	s := newFakeServer(t)
+	var mu sync.Mutex
+	ends := 0
+	s.reply = func(cmd string) string {
+		if cmd == "." {
+			mu.Lock()
+			ends++
+			mu.Unlock()
+		}
+		return ""
+	}
+
+	sc, err := s.dialer().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if err := sc.Send(testFrom, []string{testTo1}, failingWriterTo{}); err == nil {
+		t.Error("Send() should fail")
+	}
+	if err := sc.Send(testFrom, []string{testTo1}, getTestMessage()); err != nil {
+		t.Errorf("The next email should be sent, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ends != 1 {
+		t.Errorf("The partial email should not be sent, got %d emails", ends)
+	}
+}
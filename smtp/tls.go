@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A TLSPolicy defines how TLS is used to secure the connection to the SMTP
+// server.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses the STARTTLS extension if the SMTP server supports
+	// it and continues unencrypted otherwise. It is the default policy but it
+	// is vulnerable to downgrade attacks stripping STARTTLS from the reply of
+	// the server.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSMandatory requires the STARTTLS extension. Dialing fails with
+	// ErrStartTLSNotSupported if the SMTP server does not support it.
+	TLSMandatory
+	// TLSNone never uses TLS, even if the SMTP server supports STARTTLS.
+	TLSNone
+	// TLSImplicit uses TLS from the start of the connection, usually on port
+	// 465. It is the same as setting Dialer.SSL.
+	TLSImplicit
+)
+
+// ErrStartTLSNotSupported is returned when dialing with the TLSMandatory policy
+// and the SMTP server does not support the STARTTLS extension.
+var ErrStartTLSNotSupported = errors.New("gomail: the SMTP server does not support STARTTLS, which is required by the TLS policy")
+
+// ParseTLSPolicy returns the TLSPolicy matching the ConnectionSecurity field of
+// the configuration. The comparison is case-insensitive:
+//
+//	""                   TLSOpportunistic
+//	"OPPORTUNISTIC"      TLSOpportunistic
+//	"STARTTLS"           TLSMandatory
+//	"MANDATORY"          TLSMandatory
+//	"NONE", "PLAIN"      TLSNone
+//	"TLS", "SSL"         TLSImplicit
+//	"IMPLICIT"           TLSImplicit
+func ParseTLSPolicy(s string) (TLSPolicy, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "", "OPPORTUNISTIC":
+		return TLSOpportunistic, nil
+	case "STARTTLS", "MANDATORY":
+		return TLSMandatory, nil
+	case "NONE", "PLAIN":
+		return TLSNone, nil
+	case "TLS", "SSL", "IMPLICIT":
+		return TLSImplicit, nil
+	}
+	return 0, fmt.Errorf("gomail: invalid connection security %q", s)
+}
+
+func (p TLSPolicy) String() string {
+	switch p {
+	case TLSOpportunistic:
+		return "Opportunistic"
+	case TLSMandatory:
+		return "Mandatory"
+	case TLSNone:
+		return "None"
+	case TLSImplicit:
+		return "Implicit"
+	}
+	return fmt.Sprintf("TLSPolicy(%d)", int(p))
+}
+
+func (d *Dialer) tlsPolicy() TLSPolicy {
+	if d.SSL {
+		return TLSImplicit
+	}
+	return d.TLSPolicy
+}
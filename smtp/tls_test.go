@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want TLSPolicy
+	}{
+		{"", TLSOpportunistic},
+		{"opportunistic", TLSOpportunistic},
+		{"STARTTLS", TLSMandatory},
+		{"Mandatory", TLSMandatory},
+		{"NONE", TLSNone},
+		{"TLS", TLSImplicit},
+		{" ssl ", TLSImplicit},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTLSPolicy(test.s)
+		if err != nil {
+			t.Errorf("ParseTLSPolicy(%q): %v", test.s, err)
+		}
+		if got != test.want {
+			t.Errorf("ParseTLSPolicy(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+
+	if _, err := ParseTLSPolicy("STARTSSL"); err == nil {
+		t.Error("ParseTLSPolicy() should fail with an invalid value")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	tests := []struct {
+		policy  TLSPolicy
+		strip   bool
+		wantTLS bool
+		wantErr error
+	}{
+		{TLSOpportunistic, false, true, nil},
+		{TLSOpportunistic, true, false, nil},
+		{TLSMandatory, false, true, nil},
+		{TLSMandatory, true, false, ErrStartTLSNotSupported},
+		{TLSNone, false, false, nil},
+	}
+
+	for _, test := range tests {
+		s := newFakeServer(t)
+		s.stripStartTLS = test.strip
+		config := s.useTLS(false)
+		d := s.dialer()
+		d.TLSConfig = config
+		d.TLSPolicy = test.policy
+
+		sc, err := d.Dial()
+		if err != test.wantErr {
+			t.Errorf("Invalid error with %v (strip: %v), got %v, want %v", test.policy, test.strip, err, test.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		_, secure := sc.(*smtpSender).TLSConnectionState()
+		sc.Close()
+
+		if secure != test.wantTLS {
+			t.Errorf("Invalid TLS with %v (strip: %v), got %v, want %v", test.policy, test.strip, secure, test.wantTLS)
+		}
+		started := false
+		for _, cmd := range s.commands() {
+			if cmd == "STARTTLS" {
+				started = true
+			}
+		}
+		if started != test.wantTLS {
+			t.Errorf("Invalid STARTTLS with %v (strip: %v), got %v, want %v", test.policy, test.strip, started, test.wantTLS)
+		}
+	}
+}
+
+func TestTLSPolicyImplicit(t *testing.T) {
+	for _, d := range []func(*Dialer){
+		func(d *Dialer) { d.TLSPolicy = TLSImplicit },
+		func(d *Dialer) { d.SSL = true },
+	} {
+		s := newFakeServer(t)
+		config := s.useTLS(true)
+		dialer := s.dialer()
+		dialer.TLSConfig = config
+		d(dialer)
+
+		sc, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, secure := sc.(*smtpSender).TLSConnectionState()
+		sc.Close()
+		if !secure {
+			t.Error("The connection should use TLS")
+		}
+	}
+}
+
+func TestTLSPolicyUntrustedCertificate(t *testing.T) {
+	s := newFakeServer(t)
+	s.useTLS(false)
+	d := s.dialer()
+	d.TLSConfig = &tls.Config{ServerName: "127.0.0.1"}
+	d.TLSPolicy = TLSMandatory
+
+	if _, err := d.Dial(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Dial() should fail with an untrusted certificate, got %v", err)
+	}
+}
+
+func TestTLSPolicyInvalid(t *testing.T) {
+	s := newFakeServer(t)
+	d := s.dialer()
+	d.TLSPolicy = TLSPolicy(42)
+
+	if _, err := d.Dial(); err == nil {
+		t.Error("Dial() should fail with an invalid TLS policy")
+	}
+}